@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccessLogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Path is the file appended to, stdout if it is empty or "-"
+	Path string `yaml:"path"`
+	// Format is combined, the Apache Combined Log Format, or json
+	Format string `yaml:"format"`
+	// Anonymize is none, truncate to keep only the network of the client
+	// address, or hash to replace it with a keyed hash
+	Anonymize  string `yaml:"anonymize"`
+	IPv4Prefix int    `yaml:"ipv4_prefix"`
+	IPv6Prefix int    `yaml:"ipv6_prefix"`
+	// SaltRotation is how often the hash key is replaced, after which the
+	// same client can no longer be linked to its earlier requests
+	SaltRotation time.Duration `yaml:"salt_rotation"`
+}
+
+// validate checks the access log settings.
+func (c AccessLogConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	switch c.Format {
+	case "combined", "json":
+	default:
+		return fmt.Errorf("unknown access log format %q", c.Format)
+	}
+	switch c.Anonymize {
+	case "none", "hash":
+	case "truncate":
+		if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 || c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+			return fmt.Errorf("invalid access log prefix lengths %d and %d", c.IPv4Prefix, c.IPv6Prefix)
+		}
+	default:
+		return fmt.Errorf("unknown access log anonymization %q", c.Anonymize)
+	}
+	if c.Anonymize == "hash" && c.SaltRotation <= 0 {
+		return fmt.Errorf("access log salt_rotation must be positive")
+	}
+	return nil
+}
+
+// AccessLog writes a line for every request, separately from the diagnostic
+// log.
+type AccessLog struct {
+	cfg AccessLogConfig
+	now func() time.Time
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	// salt keys the client address hashes until saltExpiry
+	salt       []byte
+	saltExpiry time.Time
+}
+
+// NewAccessLog opens the access log, or returns nil if it is disabled.
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	a := &AccessLog{cfg: cfg, now: time.Now, w: os.Stdout}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reopen reopens the access log file, so that it can be rotated by renaming
+// it then sending pollen SIGHUP. If the AccessLog receiver is nil, or it
+// logs to stdout, the function does nothing.
+func (a *AccessLog) Reopen() error {
+	if a == nil || a.cfg.Path == "" || a.cfg.Path == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(a.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.w, a.file = f, f
+	return nil
+}
+
+// client returns the client address as it may be logged.
+func (a *AccessLog) client(ip net.IP) string {
+	if ip == nil {
+		return "-"
+	}
+	switch a.cfg.Anonymize {
+	case "truncate":
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(a.cfg.IPv4Prefix, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(a.cfg.IPv6Prefix, 128)).String()
+	case "hash":
+		now := a.now()
+		if now.After(a.saltExpiry) {
+			a.salt = make([]byte, 32)
+			rand.Read(a.salt)
+			a.saltExpiry = now.Add(a.cfg.SaltRotation)
+		}
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write(ip.To16())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return ip.String()
+}
+
+// accessEntry is what is logged about a request.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"ua"`
+	Duration  float64   `json:"duration"`
+	Listener  string    `json:"listener"`
+	RequestID string    `json:"request_id"`
+}
+
+// quote escapes a string for a quoted Combined Log Format field.
+func quote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// logURI returns the request URI with the value of the challenge parameter
+// redacted, since the client's nonce is what ties it to the entropy it got.
+func logURI(r *http.Request) string {
+	path, query, found := strings.Cut(r.RequestURI, "?")
+	if !found {
+		return path
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(key); err == nil && key == "challenge" {
+			params[i] = "challenge=" + redacted
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// Log writes the line for a request. If the AccessLog receiver is nil, the
+// function does nothing.
+func (a *AccessLog) Log(r *http.Request, status int, bytes int64, start time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := accessEntry{
+		Time:      start,
+		Client:    a.client(clientIP(r)),
+		Method:    r.Method,
+		URI:       logURI(r),
+		Proto:     r.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Duration:  a.now().Sub(start).Seconds(),
+		Listener:  listenerName(r.Context()),
+		RequestID: requestID(r.Context()),
+	}
+	if a.cfg.Format == "json" {
+		b, _ := json.Marshal(e)
+		a.w.Write(append(b, '\n'))
+		return
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	fmt.Fprintf(a.w, "%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		e.Client, start.Format("02/Jan/2006:15:04:05 -0700"), quote(e.Method), quote(e.URI), quote(e.Proto),
+		e.Status, size, quote(e.Referer), quote(e.UserAgent))
+}
+
+// statusRecorder remembers the status and size of a response for the
+// access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// accessLogged wraps h to write the access log line for every request.
+func (a *AccessLog) accessLogged(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := a.now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			a.Log(r, rec.status, rec.bytes, start)
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
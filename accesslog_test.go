@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAccessLog(cfg AccessLogConfig) (*AccessLog, *bytes.Buffer, *time.Time) {
+	var buf bytes.Buffer
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	a := &AccessLog{cfg: cfg, now: func() time.Time { return now }, w: &buf}
+	return a, &buf, &now
+}
+
+// TestAccessLogCombined checks a line in Combined Log Format.
+func TestAccessLogCombined(t *testing.T) {
+	a, buf, now := newTestAccessLog(AccessLogConfig{Format: "combined", Anonymize: "none"})
+	r := httptest.NewRequest("GET", "/?challenge=xxx", nil)
+	r.RemoteAddr = "192.0.2.1:4000"
+	r.Header.Set("User-Agent", `pollinate/4.33 "quoted"`)
+	a.Log(r, 200, 258, *now)
+	want := `192.0.2.1 - - [01/Mar/2024:12:30:00 +0000] "GET /?challenge=REDACTED HTTP/1.1" 200 258 "-" "pollinate/4.33 \"quoted\""` + "\n"
+	if buf.String() != want {
+		t.Errorf("expected:\n%s got:\n%s", want, buf.String())
+	}
+}
+
+// TestAccessLogChallenge checks the client's challenge never reaches the
+// access log, whichever way it is written in the query.
+func TestAccessLogChallenge(t *testing.T) {
+	for _, format := range []string{"combined", "json"} {
+		a, buf, now := newTestAccessLog(AccessLogConfig{Format: format, Anonymize: "none"})
+		for _, uri := range []string{"/?challenge=pork+chop+sandwiches", "/?x=1&challenge=pork+chop+sandwiches&y=2", "/?%63hallenge=pork+chop+sandwiches"} {
+			a.Log(httptest.NewRequest("GET", uri, nil), 200, 258, *now)
+		}
+		if strings.Contains(buf.String(), "pork") || strings.Count(buf.String(), "challenge=REDACTED") != 3 || !strings.Contains(buf.String(), "y=2") {
+			t.Errorf("%s: challenge not redacted:\n%s", format, buf.String())
+		}
+	}
+}
+
+// TestAccessLogAnonymize checks truncation and hashing of client addresses,
+// and that the hash changes once the salt is rotated.
+func TestAccessLogAnonymize(t *testing.T) {
+	a, _, _ := newTestAccessLog(AccessLogConfig{Anonymize: "truncate", IPv4Prefix: 24, IPv6Prefix: 48})
+	if c := a.client(net.ParseIP("192.0.2.77")); c != "192.0.2.0" {
+		t.Errorf("wrong truncated IPv4 address: %s", c)
+	}
+	if c := a.client(net.ParseIP("2001:db8:1:2::1")); c != "2001:db8:1::" {
+		t.Errorf("wrong truncated IPv6 address: %s", c)
+	}
+
+	a, _, now := newTestAccessLog(AccessLogConfig{Anonymize: "hash", SaltRotation: time.Hour})
+	ip := net.ParseIP("192.0.2.77")
+	first := a.client(ip)
+	if strings.Contains(first, "192") || first != a.client(ip) {
+		t.Errorf("hash is not stable or leaks the address: %s", first)
+	}
+	if a.client(net.ParseIP("192.0.2.78")) == first {
+		t.Error("different clients hashed the same")
+	}
+	*now = now.Add(2 * time.Hour)
+	if a.client(ip) == first {
+		t.Error("hash unchanged after the salt was rotated")
+	}
+}
+
+// TestAccessLogReopen serves requests through a listener handler with a
+// JSON access log file, which is rotated in between.
+func TestAccessLogReopen(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	path := filepath.Join(t.TempDir(), "access.log")
+	var err error
+	s.pollen.accessLog, err = NewAccessLog(AccessLogConfig{Enabled: true, Path: path, Format: "json", Anonymize: "none"})
+	if err != nil {
+		t.Fatalf("NewAccessLog failed: %s", err)
+	}
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy"}}))
+	defer server.Close()
+
+	get := func(query string) {
+		res, err := http.Get(server.URL + query)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+	}
+	get("?challenge=xxx")
+	os.Rename(path, path+".1")
+	s.Assert(s.pollen.accessLog.Reopen() == nil, "cannot reopen")
+	get("")
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{path + ".1", http.StatusOK},
+		{path, http.StatusBadRequest},
+	} {
+		b, err := os.ReadFile(tc.path)
+		s.Assert(err == nil, "cannot read access log:", err)
+		var e accessEntry
+		s.Assert(json.Unmarshal(b, &e) == nil, "invalid JSON: ", string(b))
+		s.Assert(e.Status == tc.status && e.Listener == "test" && e.Client == "127.0.0.1" && e.RequestID != "",
+			"unexpected entry: ", string(b))
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// notAllowed is the list reported when a client matches none of a listener's
+// allow entries.
+const notAllowed = "not_allowed"
+
+// accessRule is a set of networks a listener allows or denies, named after
+// the access list or CIDR it came from.
+type accessRule struct {
+	name string
+	nets []*net.IPNet
+}
+
+// listenerACL is the access control of one listener. Deny entries win over
+// allow entries, and if there are allow entries a client must match one.
+type listenerACL struct {
+	allow []accessRule
+	deny  []accessRule
+}
+
+// accessControl maps listener names to their access control.
+type accessControl map[string]*listenerACL
+
+// accessRules resolves allow or deny entries, each the name of one of the
+// access_lists or a CIDR.
+func (c *Config) accessRules(entries []string) ([]accessRule, error) {
+	var rules []accessRule
+	for _, e := range entries {
+		cidrs, ok := c.AccessLists[e]
+		if !ok {
+			cidrs = []string{e}
+		}
+		nets, err := parseCIDRs(cidrs)
+		if err != nil {
+			if !ok {
+				return nil, fmt.Errorf("%q is neither an access list nor a CIDR", e)
+			}
+			return nil, fmt.Errorf("access list %s: %s", e, err)
+		}
+		rules = append(rules, accessRule{e, nets})
+	}
+	return rules, nil
+}
+
+// accessControl builds the access control of every listener that has allow
+// or deny entries.
+func (c *Config) accessControl() (accessControl, error) {
+	for name, cidrs := range c.AccessLists {
+		if _, err := parseCIDRs(cidrs); err != nil {
+			return nil, fmt.Errorf("access list %s: %s", name, err)
+		}
+	}
+	acls := make(accessControl)
+	for _, spec := range c.listeners() {
+		if len(spec.Allow) == 0 && len(spec.Deny) == 0 {
+			continue
+		}
+		allow, err := c.accessRules(spec.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s allow: %s", spec.Name, err)
+		}
+		deny, err := c.accessRules(spec.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s deny: %s", spec.Name, err)
+		}
+		acls[spec.Name] = &listenerACL{allow, deny}
+	}
+	if len(c.Metrics.Allow) > 0 {
+		allow, err := c.accessRules(c.Metrics.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("metrics allow: %s", err)
+		}
+		acls[metricsListener] = &listenerACL{allow: allow}
+	}
+	if len(c.Debug.Allow) > 0 {
+		allow, err := c.accessRules(c.Debug.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("debug allow: %s", err)
+		}
+		acls[debugListener] = &listenerACL{allow: allow}
+	}
+	return acls, nil
+}
+
+// check returns the list that denies ip on the named listener, or "" if it
+// is allowed. Clients without an IP address, e.g. on a Unix socket, are left
+// to the socket's permissions. If the accessControl receiver is nil every
+// client is allowed.
+func (a *accessControl) check(listener string, ip net.IP) string {
+	if a == nil || ip == nil {
+		return ""
+	}
+	acl := (*a)[listener]
+	if acl == nil {
+		return ""
+	}
+	for _, r := range acl.deny {
+		if containsIP(r.nets, ip) {
+			return r.name
+		}
+	}
+	if len(acl.allow) == 0 {
+		return ""
+	}
+	for _, r := range acl.allow {
+		if containsIP(r.nets, ip) {
+			return ""
+		}
+	}
+	return notAllowed
+}
+
+// aclLogInterval is how often denied requests are logged at most, since a
+// blocked network can send them far faster than is worth logging.
+const aclLogInterval = time.Second
+
+// logSampler lets one log line through per interval, counting the rest.
+type logSampler struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// sample reports whether to log now and how many lines were suppressed
+// since the last one logged.
+func (s *logSampler) sample(now time.Time, interval time.Duration) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.last) < interval {
+		s.suppressed++
+		return false, 0
+	}
+	n := s.suppressed
+	s.last, s.suppressed = now, 0
+	return true, n
+}
+
+// denied answers a request refused by an access list, counting it and
+// logging it at a sampled rate.
+func (p *PollenServer) denied(w http.ResponseWriter, r *http.Request, listener, list string) {
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	p.tracker.Denied(listener, list)
+	if ok, suppressed := p.deniedLog.sample(time.Now(), aclLogInterval); ok {
+		p.log.Info("Denied request", "request_id", requestID(r.Context()), "listener", listener,
+			"client", clientAddr(r), "list", list, "suppressed", suppressed)
+	}
+}
+
+// reloadACLs rereads the configuration and replaces the access control,
+// leaving everything else as it was started.
+func (p *PollenServer) reloadACLs() error {
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+	acls, err := cfg.accessControl()
+	if err != nil {
+		return err
+	}
+	p.acls.Store(&acls)
+	return nil
+}
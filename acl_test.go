@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAccessControlCheck checks deny entries win, and that a listener with
+// allow entries refuses everyone else.
+func TestAccessControlCheck(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AccessLists = map[string][]string{
+		"rfc1918": {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+		"abusive": {"10.66.0.0/16", "2001:db8:bad::/48"},
+	}
+	cfg.Listeners = []ListenerSpec{
+		{Name: "http", Address: ":80", Allow: []string{"rfc1918"}, Deny: []string{"abusive", "192.168.1.1"}},
+		{Name: "https", Address: ":443", Scheme: "https", Deny: []string{"abusive"}},
+	}
+	acls, err := cfg.accessControl()
+	if err != nil {
+		t.Fatalf("accessControl failed: %s", err)
+	}
+	for _, tc := range []struct {
+		listener string
+		ip       string
+		list     string
+	}{
+		{"http", "10.1.2.3", ""},
+		{"http", "10.66.1.1", "abusive"},
+		{"http", "192.168.1.1", "192.168.1.1"},
+		{"http", "198.51.100.1", notAllowed},
+		{"https", "198.51.100.1", ""},
+		{"https", "2001:db8:bad::1", "abusive"},
+		{"metrics", "10.66.1.1", ""},
+	} {
+		if list := acls.check(tc.listener, net.ParseIP(tc.ip)); list != tc.list {
+			t.Errorf("%s on %s: expected %q, got %q", tc.ip, tc.listener, tc.list, list)
+		}
+	}
+	if list := acls.check("http", nil); list != "" {
+		t.Errorf("client without an address was denied by %s", list)
+	}
+
+	cfg.Listeners[0].Deny = []string{"unknown"}
+	if _, err := cfg.accessControl(); err == nil {
+		t.Error("expected an error for an unknown access list")
+	}
+}
+
+// TestLogSampler checks one line is let through per interval, along with the
+// number suppressed.
+func TestLogSampler(t *testing.T) {
+	var s logSampler
+	now := time.Unix(1700000000, 0)
+	if ok, _ := s.sample(now, time.Second); !ok {
+		t.Error("first line was suppressed")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := s.sample(now.Add(100*time.Millisecond), time.Second); ok {
+			t.Error("line within the interval was let through")
+		}
+	}
+	if ok, n := s.sample(now.Add(time.Second), time.Second); !ok || n != 3 {
+		t.Errorf("expected a line with 3 suppressed, got: %v %d", ok, n)
+	}
+}
+
+// TestForbidden checks that a denied client gets a 403, and that reloading
+// the configuration lifts the denial.
+func TestForbidden(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	defer func(path string) { *configPath = path }(*configPath)
+	spec := "listeners:\n  - name: test\n    address: \":8080\"\n    deny: [\"127.0.0.0/8\"]\n"
+	*configPath = writeConfig(t, spec)
+	s.Assert(s.pollen.reloadACLs() == nil, "cannot load access lists")
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy"}}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusForbidden, "expected Forbidden, got: ", res.Status)
+	s.Assert(len(s.logger.logs) == 1, "denied request not logged: ", s.logger.logs)
+
+	*configPath = writeConfig(t, "listeners:\n  - name: test\n    address: \":8080\"\n")
+	s.Assert(s.pollen.reloadACLs() == nil, "cannot reload access lists")
+	res, err = http.Get(server.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "still denied after reload: ", res.Status)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see
+// sd_listen_fds(3).
+var listenFdsStart = 3
+
+// activation holds the sockets passed to pollen by systemd socket activation
+// that have not been claimed by a listener yet.
+var activation struct {
+	sync.Mutex
+	once  sync.Once
+	files []*os.File
+	names []string
+}
+
+// activatedFiles collects the sockets passed in LISTEN_FDS, if they were
+// meant for this process, and unsets the variables so that they are not
+// inherited by anything pollen starts.
+func activatedFiles() {
+	activation.once.Do(func() {
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			activation.files = append(activation.files, os.NewFile(uintptr(listenFdsStart+i), name))
+			activation.names = append(activation.names, name)
+		}
+	})
+}
+
+// claimActivated takes the first passed socket accepted by match out of the
+// pool and returns it as a net.Listener.
+func claimActivated(match func(name string, ln net.Listener) bool) (net.Listener, bool) {
+	activatedFiles()
+	activation.Lock()
+	defer activation.Unlock()
+	for i, f := range activation.files {
+		if f == nil {
+			continue
+		}
+		ln, err := net.FileListener(f)
+		if err != nil {
+			// not a stream socket, it can't be used by any listener
+			continue
+		}
+		if !match(activation.names[i], ln) {
+			ln.Close()
+			continue
+		}
+		f.Close()
+		activation.files[i] = nil
+		return ln, true
+	}
+	return nil, false
+}
+
+// activatedListener returns the socket systemd passed with the given
+// FileDescriptorName.
+func activatedListener(name string) (net.Listener, error) {
+	ln, ok := claimActivated(func(n string, _ net.Listener) bool { return n == name })
+	if !ok {
+		return nil, fmt.Errorf("no socket named %q was passed by systemd", name)
+	}
+	return ln, nil
+}
+
+// inheritedListener returns a socket passed by systemd that is already bound
+// to address as network would bind it, so that a unit's ListenStream= lines
+// can take over the binding of the configured listeners without any extra
+// configuration. A wildcard only takes a socket of the same IP versions: a
+// tcp4 or tcp6 one a socket of its version alone, a tcp one a dual-stack
+// socket.
+func inheritedListener(network, address string) (net.Listener, bool) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	wildcard := host == "" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified()
+	family := ipFamily(network, host)
+	return claimActivated(func(_ string, ln net.Listener) bool {
+		tl, isTCP := ln.(*net.TCPListener)
+		if !isTCP {
+			return false
+		}
+		addr := tl.Addr().(*net.TCPAddr)
+		if strconv.Itoa(addr.Port) != port {
+			return false
+		}
+		if wildcard {
+			return addr.IP.IsUnspecified() && socketFamily(tl) == family
+		}
+		return addr.IP.Equal(net.ParseIP(host))
+	})
+}
+
+// socketFamily returns the IP version a passed TCP socket accepts
+// connections over, "4" or "6", or "" for both.
+func socketFamily(ln *net.TCPListener) string {
+	addr := ln.Addr().(*net.TCPAddr)
+	switch {
+	case addr.IP.To4() != nil:
+		return "4"
+	case !addr.IP.IsUnspecified() || v6Only(ln):
+		return "6"
+	}
+	return ""
+}
+
+// closeUnclaimed closes the sockets passed by systemd that no listener took,
+// so that they are not held open unserved, and returns their names and
+// addresses to be warned about.
+func closeUnclaimed() []string {
+	activatedFiles()
+	activation.Lock()
+	defer activation.Unlock()
+	var closed []string
+	for i, f := range activation.files {
+		if f == nil {
+			continue
+		}
+		desc := activation.names[i]
+		if ln, err := net.FileListener(f); err == nil {
+			desc += " " + ln.Addr().String()
+			ln.Close()
+		}
+		f.Close()
+		activation.files[i] = nil
+		closed = append(closed, desc)
+	}
+	return closed
+}
+
+// socketUnit returns a drop-in for pollen.socket listening on the addresses
+// of the TCP listeners, or "" if there are none, so that systemd binds them
+// in pollen's place and each is taken by its listener. A listener on a host
+// name is left for pollen to bind, and so are tcp6 wildcards alongside a tcp
+// one, since a unit's IPv6 sockets are either all dual-stack or none is.
+func (c *Config) socketUnit() string {
+	type socket struct{ network, host, port string }
+	var sockets []socket
+	dualStack := false
+	for _, l := range c.servedSpecs() {
+		if l.Network != "tcp" && l.Network != "tcp4" && l.Network != "tcp6" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if host != "" && ip == nil {
+			continue
+		}
+		if host != "" && !ip.IsUnspecified() {
+			sockets = append(sockets, socket{"", host, port})
+			continue
+		}
+		sockets = append(sockets, socket{l.Network, "", port})
+		dualStack = dualStack || l.Network == "tcp"
+	}
+	var listen []string
+	for _, s := range sockets {
+		switch {
+		case s.host != "":
+			listen = append(listen, net.JoinHostPort(s.host, s.port))
+		case s.network == "tcp4":
+			listen = append(listen, "0.0.0.0:"+s.port)
+		case s.network == "tcp6" && !dualStack:
+			listen = append(listen, "[::]:"+s.port)
+		case s.network == "tcp":
+			listen = append(listen, s.port)
+		}
+	}
+	if len(listen) == 0 {
+		return ""
+	}
+	bind := "ipv6-only"
+	if dualStack {
+		bind = "both"
+	}
+	unit := "# Generated by pollen config sockets\n[Socket]\nListenStream=\nBindIPv6Only=" + bind + "\n"
+	for _, addr := range listen {
+		unit += "ListenStream=" + addr + "\n"
+	}
+	return unit
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// v6Only reports whether an IPv6 socket refuses IPv4 connections, which a
+// ListenStream= socket does with BindIPv6Only=ipv6-only.
+func v6Only(ln *net.TCPListener) bool {
+	raw, err := ln.SyscallConn()
+	if err != nil {
+		return false
+	}
+	v6only := 0
+	raw.Control(func(fd uintptr) {
+		v6only, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY)
+	})
+	return v6only == 1
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// v6Only can't tell whether an IPv6 socket refuses IPv4 connections, and
+// sockets are only passed by systemd anyway.
+func v6Only(ln *net.TCPListener) bool {
+	return false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// passSockets pretends systemd passed the given listeners, by duplicating
+// them to consecutive descriptors and setting LISTEN_*.
+func passSockets(t *testing.T, names string, lns ...net.Listener) {
+	start := -1
+	for i, ln := range lns {
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(int(f.Fd()))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			start = fd
+		} else if fd != start+i {
+			t.Skip("cannot allocate consecutive file descriptors")
+		}
+	}
+	listenFdsStart = start
+	activation.once = sync.Once{}
+	activation.files, activation.names = nil, nil
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(lns)))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+// TestSocketActivation checks that passed sockets are found by name and by
+// the address they are bound to.
+func TestSocketActivation(t *testing.T) {
+	a, _ := net.Listen("tcp", "127.0.0.1:0")
+	b, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer a.Close()
+	defer b.Close()
+	passSockets(t, "first:second", a, b)
+
+	ln, err := openListener(ListenerSpec{Name: "by-address", Network: "tcp", Address: b.Addr().String()})
+	if err != nil {
+		t.Fatalf("openListener failed: %s", err)
+	}
+	if ln.Addr().String() != b.Addr().String() {
+		t.Errorf("expected the inherited socket at %s, got: %s", b.Addr(), ln.Addr())
+	}
+	ln.Close()
+	ln, err = openListener(ListenerSpec{Name: "by-name", Network: "systemd", Address: "first"})
+	if err != nil {
+		t.Fatalf("openListener failed: %s", err)
+	}
+	if ln.Addr().String() != a.Addr().String() {
+		t.Errorf("expected the socket named first at %s, got: %s", a.Addr(), ln.Addr())
+	}
+	ln.Close()
+	if _, err := openListener(ListenerSpec{Name: "again", Network: "systemd", Address: "first"}); err == nil {
+		t.Error("a passed socket was handed out twice")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS was not unset")
+	}
+}
+
+// TestInheritedFamilies checks a wildcard listener only takes a passed
+// socket accepting the same IP versions it would bind.
+func TestInheritedFamilies(t *testing.T) {
+	v4, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v4.Close()
+	v6, err := net.Listen("tcp6", "[::]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %s", err)
+	}
+	defer v6.Close()
+	dual, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dual.Close()
+	passSockets(t, "v4:v6:dual", v4, v6, dual)
+
+	port := func(ln net.Listener) string { return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) }
+	for _, tc := range []struct {
+		network, address string
+		ok               bool
+	}{
+		{"tcp6", "[::]:" + port(v4), false},
+		{"tcp", ":" + port(v4), false},
+		{"tcp4", ":" + port(v4), true},
+		{"tcp4", "0.0.0.0:" + port(v6), false},
+		{"tcp", "[::]:" + port(v6), false},
+		{"tcp6", ":" + port(v6), true},
+		{"tcp4", ":" + port(dual), false},
+		{"tcp6", ":" + port(dual), false},
+		{"tcp", "0.0.0.0:" + port(dual), true},
+	} {
+		ln, ok := inheritedListener(tc.network, tc.address)
+		if ok != tc.ok {
+			t.Errorf("%s %s: took a passed socket %v, expected %v", tc.network, tc.address, ok, tc.ok)
+		}
+		if ok {
+			ln.Close()
+		}
+	}
+}
+
+// TestSocketUnit checks the pollen.socket drop-in binds what the listeners
+// would, with the IP versions they would.
+func TestSocketUnit(t *testing.T) {
+	for _, tc := range []struct {
+		listeners []ListenerSpec
+		unit      string
+	}{
+		{nil, "BindIPv6Only=both\nListenStream=80\nListenStream=443\n"},
+		{[]ListenerSpec{
+			{Name: "v4", Network: "tcp4", Address: ":80"},
+			{Name: "v6", Network: "tcp6", Address: "[::]:80"},
+			{Name: "local", Network: "tcp", Address: "127.0.0.1:8080"},
+			{Name: "named", Network: "tcp", Address: "localhost:8081"},
+			{Name: "unix", Network: "unix", Address: "/run/pollen/pollen.sock"},
+		}, "BindIPv6Only=ipv6-only\nListenStream=0.0.0.0:80\nListenStream=[::]:80\nListenStream=127.0.0.1:8080\n"},
+		{[]ListenerSpec{
+			{Name: "v6", Network: "tcp6", Address: "[::]:80"},
+			{Name: "dual", Network: "tcp", Address: "[::]:443"},
+			{Name: "public", Network: "tcp6", Address: "[2001:db8::1]:8443"},
+		}, "BindIPv6Only=both\nListenStream=443\nListenStream=[2001:db8::1]:8443\n"},
+		{[]ListenerSpec{{Name: "unix", Network: "unix", Address: "/run/pollen/pollen.sock"}}, ""},
+	} {
+		cfg := defaultConfig()
+		cfg.Listeners = tc.listeners
+		unit := cfg.socketUnit()
+		if tc.unit != "" {
+			tc.unit = "# Generated by pollen config sockets\n[Socket]\nListenStream=\n" + tc.unit
+		}
+		if unit != tc.unit {
+			t.Errorf("%v: got\n%s\nexpected\n%s", tc.listeners, unit, tc.unit)
+		}
+	}
+}
+
+// TestUnclaimedSockets checks the passed sockets no listener took are closed
+// and reported.
+func TestUnclaimedSockets(t *testing.T) {
+	a, _ := net.Listen("tcp", "127.0.0.1:0")
+	b, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer a.Close()
+	defer b.Close()
+	passSockets(t, "first:second", a, b)
+
+	ln, err := openListener(ListenerSpec{Name: "by-name", Network: "systemd", Address: "first"})
+	if err != nil {
+		t.Fatalf("openListener failed: %s", err)
+	}
+	defer ln.Close()
+	closed := closeUnclaimed()
+	if len(closed) != 1 || closed[0] != "second "+b.Addr().String() {
+		t.Errorf("expected second to be closed, got: %v", closed)
+	}
+	if closed := closeUnclaimed(); len(closed) != 0 {
+		t.Errorf("sockets closed twice: %v", closed)
+	}
+}
+
+// TestUnixListener serves pollen over a Unix socket and checks the socket's
+// permissions.
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pollen.sock")
+	spec := ListenerSpec{Name: "local", Network: "unix", Address: path, Mode: "0600", Routes: []string{"entropy"}}
+	// a stale socket from a previous run is replaced
+	stale, _ := net.Listen("unix", path)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := openListener(spec)
+	if err != nil {
+		t.Fatalf("openListener failed: %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong socket permissions: %v %v", fi.Mode(), err)
+	}
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := &http.Server{Handler: s.pollen.listenerHandler(spec)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://pollen/?challenge=pork+chop+sandwiches")
+	if err != nil {
+		t.Fatalf("http client error: %s", err)
+	}
+	defer res.Body.Close()
+	chal, _, err := ReadResp(res.Body)
+	if err != nil || chal != PorkChopSha512 {
+		t.Errorf("unexpected response %q: %v", chal, err)
+	}
+
+	if _, err := (ListenerSpec{Mode: "999"}).socketMode(); err == nil {
+		t.Error("expected an invalid mode error")
+	}
+}
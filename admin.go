@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AdminConfig struct {
+	// Enabled serves the admin API on a Unix socket
+	Enabled bool `yaml:"enabled"`
+	// Socket is the path of the socket, and Mode and Group its permissions
+	Socket string `yaml:"socket"`
+	Mode   string `yaml:"mode"`
+	Group  string `yaml:"group"`
+	// Users may use the admin API besides root and the user pollen runs as
+	Users []string `yaml:"users"`
+}
+
+// adminListener is the name of the admin socket among the listeners.
+const adminListener = "admin"
+
+// processStart is when pollen started, for the uptime in the admin status.
+var processStart = time.Now()
+
+// adminSpec returns the admin socket, if the admin API is enabled.
+func (c *Config) adminSpec() (ListenerSpec, bool) {
+	if !c.Admin.Enabled {
+		return ListenerSpec{}, false
+	}
+	return ListenerSpec{Name: adminListener, Network: "unix", Address: c.Admin.Socket, Scheme: "http", Mode: c.Admin.Mode, Group: c.Admin.Group}, true
+}
+
+// adminUIDs returns the users allowed to use the admin API, besides root and
+// the user pollen runs as.
+func (c *Config) adminUIDs() ([]int, error) {
+	var uids []int
+	for _, name := range c.Admin.Users {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("admin user: %s", err)
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// peer is the process at the other end of an admin connection, as the kernel
+// tells it.
+type peer struct {
+	uid, pid int
+	err      error
+}
+
+type peerKey struct{}
+
+// adminConnContext records the credentials of the process connecting to the
+// admin socket, for the handler to check.
+func adminConnContext(ctx context.Context, c net.Conn) context.Context {
+	uid, pid, err := peerCredentials(c)
+	return context.WithValue(ctx, peerKey{}, peer{uid, pid, err})
+}
+
+// adminAction is an admin API endpoint, returning what it did.
+type adminAction func(r *http.Request) (string, error)
+
+// adminHandler returns the handler for the admin socket. Only root, the user
+// pollen runs as and those in uids are let in, and every action is logged,
+// whether it is carried out or not.
+func (p *PollenServer) adminHandler(uids []int) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern, action string, f adminAction) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			peer, _ := r.Context().Value(peerKey{}).(peer)
+			attrs := []any{"event", "admin", "action", action, "uid", peer.uid, "pid", peer.pid}
+			if r.ParseForm() == nil && len(r.PostForm) > 0 {
+				attrs = append(attrs, "args", r.PostForm.Encode())
+			}
+			if peer.err != nil || (peer.uid != 0 && peer.uid != os.Geteuid() && !slices.Contains(uids, peer.uid)) {
+				p.log.Warn("Admin action refused", attrs...)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			result, err := f(r)
+			if err != nil {
+				p.log.Error("Admin action failed", append(attrs, "error", err)...)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.log.Info("Admin action", attrs...)
+			io.WriteString(w, result)
+		})
+	}
+	handle("GET /status", "status", p.adminStatus)
+	handle("POST /drain", "drain", func(*http.Request) (string, error) {
+		p.setMaintenance(maintenanceAdmin, true)
+		return "draining\n", nil
+	})
+	handle("POST /undrain", "undrain", func(*http.Request) (string, error) {
+		p.setMaintenance(maintenanceAdmin, false)
+		if sources := p.maintenance.active(); len(sources) > 0 {
+			return fmt.Sprintf("still in maintenance by %s\n", strings.Join(sources, ", ")), nil
+		}
+		return "serving\n", nil
+	})
+	handle("POST /read-size", "read-size", func(r *http.Request) (string, error) {
+		n, err := strconv.Atoi(r.FormValue("bytes"))
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("invalid read size %q", r.FormValue("bytes"))
+		}
+		p.readSize.Store(int64(n))
+		return fmt.Sprintf("read size %d\n", n), nil
+	})
+	handle("POST /reload", "reload", func(*http.Request) (string, error) {
+		if err := p.reloadACLs(); err != nil {
+			return "", fmt.Errorf("cannot reload access lists: %s", err)
+		}
+		for _, cert := range p.certs {
+			if err := cert.load(); err != nil {
+				return "", fmt.Errorf("cannot reload certificate: %s", err)
+			}
+		}
+		return fmt.Sprintf("reloaded access lists and %d certificates\n", len(p.certs)), nil
+	})
+	handle("POST /log-level", "log-level", func(r *http.Request) (string, error) {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			return "", fmt.Errorf("unknown log level %q", r.FormValue("level"))
+		}
+		p.logLevel.Set(level)
+		return fmt.Sprintf("log level %s\n", level), nil
+	})
+	return mux
+}
+
+// adminStatus describes what pollen is doing, as JSON.
+func (p *PollenServer) adminStatus(*http.Request) (string, error) {
+	stats := p.entropy.Stats()
+	inFlight, queued := p.concurrency.counts()
+	sources := p.maintenance.active()
+	level := "info"
+	if p.logLevel != nil {
+		level = strings.ToLower(p.logLevel.Level().String())
+	}
+	b, err := json.MarshalIndent(map[string]any{
+		"version":            version,
+		"uptime":             time.Since(processStart).Round(time.Second).String(),
+		"starting":           p.starting.Load(),
+		"draining":           len(sources) > 0,
+		"maintenance":        sources,
+		"read_size":          p.readSize.Load(),
+		"log_level":          level,
+		"certificates":       len(p.certs),
+		"requests_in_flight": inFlight,
+		"requests_queued":    queued,
+		"entropy_avail":      stats.EntropyAvail,
+		"crng_ready":         stats.CRNGReady,
+		"log_dropped":        p.logQueue.Dropped(),
+	}, "", "  ")
+	return string(b) + "\n", err
+}
+
+// adminClient returns a client for the admin API on socket.
+func adminClient(socket string) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// adminRequest sends a command to the admin API and returns its answer.
+func adminRequest(client *http.Client, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no command given")
+	}
+	var res *http.Response
+	var err error
+	switch cmd := args[0]; {
+	case cmd == "status" && len(args) == 1:
+		res, err = client.Get("http://pollen/status")
+	case (cmd == "drain" || cmd == "undrain" || cmd == "reload") && len(args) == 1:
+		res, err = client.PostForm("http://pollen/"+cmd, nil)
+	case cmd == "read-size" && len(args) == 2:
+		res, err = client.PostForm("http://pollen/read-size", url.Values{"bytes": {args[1]}})
+	case cmd == "log-level" && len(args) == 2:
+		res, err = client.PostForm("http://pollen/log-level", url.Values{"level": {args[1]}})
+	default:
+		return "", fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+func ctlMain(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", defaultConfig().Admin.Socket, "The admin API socket")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pollen ctl [-socket path] status|drain|undrain|reload|read-size bytes|log-level level")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	out, err := adminRequest(adminClient(*socket), fs.Args())
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Print(out)
+}
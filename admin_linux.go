@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the user and process ID of the process at the
+// other end of a Unix socket, as the kernel recorded them when it connected.
+func peerCredentials(c net.Conn) (int, int, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return -1, 0, errors.New("not a Unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return -1, 0, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return -1, 0, err
+	}
+	return int(cred.Uid), int(cred.Pid), nil
+}
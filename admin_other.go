@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials can't tell who is connecting, so the admin API refuses
+// everyone.
+func peerCredentials(c net.Conn) (int, int, error) {
+	return -1, 0, errors.New("peer credentials are only supported on Linux")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestAdminAPI drives pollen through its admin socket, checking each action
+// takes effect and is audited.
+func TestAdminAPI(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.logLevel = new(slog.LevelVar)
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	server := &http.Server{Handler: s.pollen.adminHandler(nil), ConnContext: adminConnContext}
+	go server.Serve(ln)
+	defer server.Close()
+	client := adminClient(socket)
+
+	ctl := func(args ...string) string {
+		out, err := adminRequest(client, args)
+		if err != nil {
+			t.Fatalf("%v: %s", args, err)
+		}
+		return out
+	}
+	get := func() *http.Response {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		if err != nil {
+			t.Fatalf("http client error: %s", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	ctl("drain")
+	res := get()
+	s.Assert(res.StatusCode == http.StatusServiceUnavailable && res.Header.Get("Retry-After") == "30", "drained pollen answered", res.Status)
+	rec := httptest.NewRecorder()
+	s.pollen.serveReady(rec, httptest.NewRequest("GET", "/readyz", nil))
+	s.Assert(rec.Code == http.StatusServiceUnavailable, "drained pollen is ready")
+	ctl("undrain")
+	s.Assert(get().StatusCode == http.StatusOK, "undrained pollen doesn't serve")
+
+	ctl("read-size", "32")
+	ctl("log-level", "debug")
+	s.Assert(s.pollen.logLevel.Level() == slog.LevelDebug, "log level not set:", s.pollen.logLevel.Level())
+	var status map[string]any
+	if err := json.Unmarshal([]byte(ctl("status")), &status); err != nil {
+		t.Fatalf("cannot decode status: %s", err)
+	}
+	s.Assert(status["read_size"] == 32.0 && status["log_level"] == "debug" && status["draining"] == false, "wrong status:", status)
+
+	for _, args := range [][]string{{"read-size", "-1"}, {"log-level", "loud"}, {"drain", "now"}} {
+		if _, err := adminRequest(client, args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+	s.Assert(s.pollen.readSize.Load() == 32, "invalid read size applied")
+
+	s.logger.mu.Lock()
+	defer s.logger.mu.Unlock()
+	var actions []string
+	for _, entry := range s.logger.logs {
+		if strings.HasPrefix(entry.message, "Admin action") {
+			actions = append(actions, entry.attrs["action"])
+		}
+	}
+	want := "drain undrain read-size log-level status read-size log-level"
+	s.Assert(strings.Join(actions, " ") == want, "audited", actions, "expected", want)
+}
+
+// TestAdminRefused checks other users are turned away and their attempts
+// logged.
+func TestAdminRefused(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	h := s.pollen.adminHandler([]int{4242})
+	for _, tc := range []struct {
+		peer peer
+		code int
+	}{
+		{peer{uid: os.Geteuid() + 1000, pid: 1}, http.StatusForbidden},
+		{peer{uid: 4242, pid: 1}, http.StatusOK},
+		{peer{uid: 0, pid: 1}, http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/drain", nil)
+		req = req.WithContext(context.WithValue(req.Context(), peerKey{}, tc.peer))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		s.Assert(rec.Code == tc.code, "uid", tc.peer.uid, "got", rec.Code)
+	}
+	s.logger.mu.Lock()
+	defer s.logger.mu.Unlock()
+	s.Assert(s.logger.logs[0].message == "Admin action refused", "refusal not logged:", s.logger.logs[0])
+}
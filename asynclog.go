@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// logEvents are the classes of message that can be sampled, named by the
+// "event" attribute they are logged with.
+var logEvents = map[string]bool{"challenge": true, "response": true}
+
+// validateSampling checks log.sample names known events with positive rates.
+func validateSampling(sample map[string]int) error {
+	for event, n := range sample {
+		if !logEvents[event] {
+			return fmt.Errorf("unknown log event %q to sample", event)
+		}
+		if n < 1 {
+			return fmt.Errorf("log sample rate for %s must be positive", event)
+		}
+	}
+	return nil
+}
+
+// logQueue hands records to a goroutine that passes them to the backend, so
+// that a stalled backend never holds up the caller. When the queue is full
+// records are dropped and counted.
+type logQueue struct {
+	records chan queuedRecord
+	dropped atomic.Int64
+}
+
+type queuedRecord struct {
+	h slog.Handler
+	r slog.Record
+}
+
+func newLogQueue(size int) *logQueue {
+	q := &logQueue{records: make(chan queuedRecord, size)}
+	go func() {
+		for qr := range q.records {
+			qr.h.Handle(context.Background(), qr.r)
+		}
+	}()
+	return q
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+// If the logQueue receiver is nil, it returns 0.
+func (q *logQueue) Dropped() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.dropped.Load()
+}
+
+// asyncHandler queues records for next. Critical records are handled
+// straight away instead, since pollen is about to exit.
+type asyncHandler struct {
+	next  slog.Handler
+	queue *logQueue
+}
+
+func (h *asyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *asyncHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= LevelCritical {
+		return h.next.Handle(ctx, r)
+	}
+	select {
+	case h.queue.records <- queuedRecord{h.next, r.Clone()}:
+	default:
+		h.queue.dropped.Add(1)
+	}
+	return nil
+}
+
+func (h *asyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &asyncHandler{h.next.WithAttrs(attrs), h.queue}
+}
+
+func (h *asyncHandler) WithGroup(name string) slog.Handler {
+	return &asyncHandler{h.next.WithGroup(name), h.queue}
+}
+
+// sampleHandler passes on only 1 in N of the records of each sampled event
+// class. Warnings and errors are always passed on.
+type sampleHandler struct {
+	next  slog.Handler
+	rates map[string]int
+	seen  map[string]*atomic.Uint64
+}
+
+func newSampleHandler(next slog.Handler, rates map[string]int) *sampleHandler {
+	seen := make(map[string]*atomic.Uint64)
+	for event := range rates {
+		seen[event] = new(atomic.Uint64)
+	}
+	return &sampleHandler{next, rates, seen}
+}
+
+func (h *sampleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		var event string
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "event" {
+				event = a.Value.String()
+				return false
+			}
+			return true
+		})
+		if n := h.rates[event]; n > 1 && (h.seen[event].Add(1)-1)%uint64(n) != 0 {
+			return nil
+		}
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampleHandler{h.next.WithAttrs(attrs), h.rates, h.seen}
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	return &sampleHandler{h.next.WithGroup(name), h.rates, h.seen}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// stalledHandler blocks every record until release is closed, like a
+// backend that stopped reading.
+type stalledHandler struct {
+	release chan struct{}
+	handled chan slog.Record
+}
+
+func (h *stalledHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *stalledHandler) Handle(_ context.Context, r slog.Record) error {
+	<-h.release
+	h.handled <- r
+	return nil
+}
+
+func (h *stalledHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *stalledHandler) WithGroup(string) slog.Handler      { return h }
+
+// TestAsyncLogStalled checks logging doesn't wait on a stalled backend, that
+// the messages that don't fit in the queue are counted, and that critical
+// messages wait for the backend.
+func TestAsyncLogStalled(t *testing.T) {
+	next := &stalledHandler{release: make(chan struct{}), handled: make(chan slog.Record, 100)}
+	queue := newLogQueue(2)
+	log := slog.New(&asyncHandler{next, queue})
+
+	// wait for the first message to be with the backend
+	log.Info("message")
+	for len(queue.records) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 9; i++ {
+			log.Info("message")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging blocked on a stalled backend")
+	}
+	// one message is with the backend and two are queued
+	if d := queue.Dropped(); d != 7 {
+		t.Errorf("expected 7 dropped messages, got %d", d)
+	}
+
+	critical := make(chan struct{})
+	go func() {
+		log.Log(context.Background(), LevelCritical, "exiting")
+		close(critical)
+	}()
+	close(next.release)
+	<-critical
+	for i := 0; i < 4; i++ {
+		select {
+		case <-next.handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d messages reached the backend", i)
+		}
+	}
+}
+
+// TestSampleLog checks only 1 in N messages of a sampled event are logged,
+// and that warnings and other messages always are.
+func TestSampleLog(t *testing.T) {
+	logger := &localLogger{}
+	log := slog.New(newSampleHandler(&localHandler{l: logger}, map[string]int{"response": 3}))
+	for i := 0; i < 9; i++ {
+		log.Info("Server sent response", "event", "response")
+	}
+	log.Warn("Server sent response", "event", "response")
+	log.Info("Server received challenge", "event", "challenge")
+	log.Info("Other")
+
+	if n := len(logger.logs); n != 6 {
+		t.Errorf("expected 6 messages, got %d: %v", n, logger.logs)
+	}
+}
+
+// TestLogConfigSampling checks the queue size and sample rates.
+func TestLogConfigSampling(t *testing.T) {
+	for _, tc := range []struct {
+		cfg LogConfig
+		ok  bool
+	}{
+		{LogConfig{Backend: "text", Level: "info", Queue: 0, Sample: map[string]int{"challenge": 10}}, true},
+		{LogConfig{Backend: "text", Level: "info", Queue: -1}, false},
+		{LogConfig{Backend: "text", Level: "info", Sample: map[string]int{"response": 0}}, false},
+		{LogConfig{Backend: "text", Level: "info", Sample: map[string]int{"error": 2}}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%v: unexpected result: %v", tc.cfg, err)
+		}
+	}
+}
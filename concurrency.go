@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimiter bounds the number of requests being served at once and
+// the number waiting for their turn, so that a blocking device sheds load
+// instead of piling up goroutines.
+type ConcurrencyLimiter struct {
+	// slots is nil when the number of requests in flight is unlimited
+	slots     chan struct{}
+	maxQueued int
+	timeout   time.Duration
+	// report is called with the new counts whenever they change
+	report func(inFlight, queued int)
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter allowing maxInFlight
+// requests at once, unlimited if zero, with up to maxQueued more waiting at
+// most timeout for a slot.
+func NewConcurrencyLimiter(maxInFlight, maxQueued int, timeout time.Duration, report func(inFlight, queued int)) *ConcurrencyLimiter {
+	c := &ConcurrencyLimiter{maxQueued: maxQueued, timeout: timeout, report: report}
+	if maxInFlight > 0 {
+		c.slots = make(chan struct{}, maxInFlight)
+	}
+	return c
+}
+
+func (c *ConcurrencyLimiter) add(inFlight, queued int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight += inFlight
+	c.queued += queued
+	if c.report != nil {
+		c.report(c.inFlight, c.queued)
+	}
+}
+
+// enqueue counts a request as waiting for a slot, unless the queue is full.
+// The check and the count are made together, so that requests arriving at
+// once can't overfill the queue.
+func (c *ConcurrencyLimiter) enqueue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queued >= c.maxQueued {
+		return false
+	}
+	c.queued++
+	if c.report != nil {
+		c.report(c.inFlight, c.queued)
+	}
+	return true
+}
+
+func (c *ConcurrencyLimiter) release() {
+	if c.slots != nil {
+		<-c.slots
+	}
+	c.add(-1, 0)
+}
+
+// Acquire waits for a slot to serve a request. It returns false straight
+// away if the queue is full, or once the wait times out or the client goes
+// away; otherwise the returned function must be called when the request is
+// done. If the ConcurrencyLimiter receiver is nil every request is allowed.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) (func(), bool) {
+	if c == nil {
+		return func() {}, true
+	}
+	if c.slots == nil {
+		c.add(1, 0)
+		return c.release, true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		c.add(1, 0)
+		return c.release, true
+	default:
+	}
+	if !c.enqueue() {
+		return nil, false
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		c.add(1, -1)
+		return c.release, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	c.add(0, -1)
+	return nil, false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingDev is a device whose reads block until unblock is closed.
+type blockingDev struct {
+	unblock chan struct{}
+}
+
+func (d *blockingDev) Read(p []byte) (int, error) {
+	<-d.unblock
+	return len(p), nil
+}
+
+func (d *blockingDev) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// TestConcurrencyLimiterTimeout checks that a queued request gives up after
+// the timeout and that the counts are reported.
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	var inFlight, queued int
+	c := NewConcurrencyLimiter(1, 1, 10*time.Millisecond, func(i, q int) { inFlight, queued = i, q })
+	release, ok := c.Acquire(context.Background())
+	if !ok || inFlight != 1 {
+		t.Fatalf("first request refused or not counted: %v %d", ok, inFlight)
+	}
+	if _, ok := c.Acquire(context.Background()); ok {
+		t.Error("queued request did not time out")
+	}
+	if queued != 0 {
+		t.Errorf("timed out request still counted as queued: %d", queued)
+	}
+	release()
+	if inFlight != 0 {
+		t.Errorf("released request still counted in flight: %d", inFlight)
+	}
+	if _, ok := c.Acquire(context.Background()); !ok {
+		t.Error("request refused once the slot was released")
+	}
+}
+
+// TestConcurrencyLimiterUnlimited checks that requests are only counted when
+// there is no limit.
+func TestConcurrencyLimiterUnlimited(t *testing.T) {
+	var inFlight int
+	c := NewConcurrencyLimiter(0, 0, 0, func(i, q int) { inFlight = i })
+	for i := 0; i < 10; i++ {
+		if _, ok := c.Acquire(context.Background()); !ok {
+			t.Fatal("request refused without a limit")
+		}
+	}
+	if inFlight != 10 {
+		t.Errorf("expected 10 requests in flight, got: %d", inFlight)
+	}
+}
+
+// TestConcurrencyLimiterQueue starts many requests at once while the only
+// slot is taken, and checks that no more than the queue holds wait for it.
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	const maxQueued = 3
+	var maxSeen int
+	c := NewConcurrencyLimiter(1, maxQueued, time.Minute, func(_, q int) { maxSeen = max(maxSeen, q) })
+	release, _ := c.Acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			c.Acquire(ctx)
+		}()
+	}
+	close(start)
+	// the requests turned away return at once, the queued ones on cancel
+	deadline := time.Now().Add(5 * time.Second)
+	for _, queued := c.counts(); queued < maxQueued && time.Now().Before(deadline); _, queued = c.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	release()
+	if _, queued := c.counts(); maxSeen > maxQueued || queued != 0 {
+		t.Errorf("expected at most %d queued and none left, got: %d and %d", maxQueued, maxSeen, queued)
+	}
+}
+
+// TestServiceUnavailable fills the only slot and the queue with requests
+// blocked on the device, and checks that the next one is refused with a 503
+// straight away while the queued one is served once the device unblocks.
+func TestServiceUnavailable(t *testing.T) {
+	dev := &blockingDev{unblock: make(chan struct{})}
+	s := NewSuiteWithDev(t, dev)
+	defer s.TearDown()
+	counts := make(chan [2]int, 10)
+	s.pollen.concurrency = NewConcurrencyLimiter(1, 1, time.Minute, func(i, q int) { counts <- [2]int{i, q} })
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(s.URL + "?challenge=xxx")
+			if err != nil {
+				t.Errorf("http client error: %s", err)
+				return
+			}
+			res.Body.Close()
+			codes <- res.StatusCode
+		}()
+		<-counts
+	}
+
+	start := time.Now()
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusServiceUnavailable, "expected Service Unavailable, got: ", res.Status)
+	s.Assert(res.Header.Get("Retry-After") == "1", "wrong Retry-After: ", res.Header.Get("Retry-After"))
+	s.Assert(time.Since(start) < 5*time.Second, "refusal was not immediate")
+
+	close(dev.unblock)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		s.Assert(code == http.StatusOK, "blocked request failed: ", code)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete pollen configuration. It is assembled from the
+// built-in defaults, the -config file, POLLEN_* environment variables and the
+// command line flags, each overriding the one before.
+type Config struct {
+	HTTP        ListenerConfig       `yaml:"http"`
+	HTTPS       ListenerConfig       `yaml:"https"`
+	Listeners   []ListenerSpec       `yaml:"listeners"`
+	TLS         TLSConfig            `yaml:"tls"`
+	TLSProfiles map[string]TLSConfig `yaml:"tls_profiles"`
+	Source      SourceConfig         `yaml:"source"`
+	Metrics     MetricsConfig        `yaml:"metrics"`
+	Limits      LimitsConfig         `yaml:"limits"`
+	Server      ServerConfig         `yaml:"server"`
+	Proxy       ProxyConfig          `yaml:"proxy"`
+	// AccessLists names lists of CIDRs for the listeners' allow and deny
+	AccessLists map[string][]string `yaml:"access_lists"`
+	Privileges  PrivilegesConfig    `yaml:"privileges"`
+	Sandbox     SandboxConfig       `yaml:"sandbox"`
+	Log         LogConfig           `yaml:"log"`
+	AccessLog   AccessLogConfig     `yaml:"access_log"`
+	Tracing     TracingConfig       `yaml:"tracing"`
+	Debug       DebugConfig         `yaml:"debug"`
+	Admin       AdminConfig         `yaml:"admin"`
+	Maintenance MaintenanceConfig   `yaml:"maintenance"`
+}
+
+type ListenerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Autogen creates a self-signed Cert and Key at startup if either is missing
+	Autogen    bool   `yaml:"autogen"`
+	MinVersion string `yaml:"min_version"`
+}
+
+type SourceConfig struct {
+	// Device is usually /dev/random or /dev/urandom
+	Device string `yaml:"device"`
+	// SampleInterval is how often the kernel's random pool statistics are
+	// read
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	// CRNGTimeout bounds the wait at startup for the kernel's CRNG to be
+	// seeded before entropy is served
+	CRNGTimeout time.Duration `yaml:"crng_timeout"`
+}
+
+type LimitsConfig struct {
+	// ReadSize is the number of bytes read from the device for each response
+	ReadSize int `yaml:"read_size"`
+	// MaxInFlight bounds the requests served at once, unlimited if zero
+	MaxInFlight int `yaml:"max_in_flight"`
+	// MaxQueued bounds the requests waiting for one of those, and
+	// QueueTimeout how long they wait, before being refused with a 503
+	MaxQueued    int             `yaml:"max_queued"`
+	QueueTimeout time.Duration   `yaml:"queue_timeout"`
+	RateLimit    RateLimitConfig `yaml:"rate_limit"`
+}
+
+type PrivilegesConfig struct {
+	// User and Group are switched to after binding, unless User is empty
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
+
+type SandboxConfig struct {
+	// Enabled confines pollen with Landlock and seccomp once it is serving
+	Enabled bool `yaml:"enabled"`
+}
+
+// defaultConfig returns the configuration used when nothing else is given.
+func defaultConfig() *Config {
+	return &Config{
+		HTTP:   ListenerConfig{Enabled: true, Port: 80},
+		HTTPS:  ListenerConfig{Enabled: true, Port: 443},
+		TLS:    TLSConfig{Cert: "/etc/pollen/cert.pem", Key: "/etc/pollen/key.pem", MinVersion: "1.0"},
+		Source: SourceConfig{Device: "/dev/random", SampleInterval: 10 * time.Second, CRNGTimeout: 2 * time.Minute},
+		Metrics: MetricsConfig{
+			Enabled:          false,
+			Port:             2112,
+			Path:             "/metrics",
+			GoCollector:      true,
+			ProcessCollector: true,
+			Histograms:       HistogramsConfig{NativeBucketFactor: 1.1},
+			Push:             PushConfig{Interval: 15 * time.Second, Pushgateway: PushgatewayConfig{Job: "pollen"}},
+		},
+		Debug: DebugConfig{Address: "localhost:6060"},
+		Admin: AdminConfig{Socket: "/run/pollen/admin.sock", Mode: "0600"},
+		Maintenance: MaintenanceConfig{
+			Message:    defaultMaintenanceMessage,
+			RetryAfter: defaultRetryAfter,
+			Interval:   time.Second,
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			MaxHeaderBytes:    8 << 10,
+			MaxBodyBytes:      4 << 10,
+		},
+		Limits: LimitsConfig{
+			ReadSize:     64,
+			MaxInFlight:  256,
+			MaxQueued:    256,
+			QueueTimeout: time.Second,
+			RateLimit:    RateLimitConfig{Rate: 1, Burst: 10, MaxClients: 100000, IPv6Prefix: 64},
+		},
+		Sandbox: SandboxConfig{Enabled: true},
+		Log:     LogConfig{Backend: "syslog", Level: "info", Remote: RemoteSyslogConfig{Network: "tcp", Buffer: 1024}, Queue: 4096},
+		AccessLog: AccessLogConfig{
+			Format:       "combined",
+			Anonymize:    "none",
+			IPv4Prefix:   24,
+			IPv6Prefix:   48,
+			SaltRotation: 24 * time.Hour,
+		},
+		Tracing: TracingConfig{Buffer: 2048, Interval: 5 * time.Second},
+	}
+}
+
+// flagKeys maps the command line flags to the configuration keys they set.
+var flagKeys = map[string]string{
+	"http-port":     "http.port",
+	"https-port":    "https.port",
+	"metrics-port":  "metrics.port",
+	"device":        "source.device",
+	"bytes":         "limits.read_size",
+	"cert":          "tls.cert",
+	"key":           "tls.key",
+	"https-autogen": "tls.autogen",
+	"user":          "privileges.user",
+	"group":         "privileges.group",
+	"sandbox":       "sandbox.enabled",
+	"log-backend":   "log.backend",
+	"log-level":     "log.level",
+}
+
+const envPrefix = "POLLEN_"
+
+// loadConfig builds the configuration from the -config file, the environment
+// and the flags that were explicitly given on the command line, then
+// validates it.
+func loadConfig() (*Config, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// readConfig builds the configuration like loadConfig without validating
+// it, which needs more than pollen can reach once it is sandboxed.
+func readConfig() (*Config, error) {
+	cfg := defaultConfig()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = cfg.applyFlag(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads a YAML configuration file on top of c. Keys that pollen does
+// not know about are an error rather than silently ignored.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides configuration keys from POLLEN_<SECTION>_<KEY>
+// environment variables, e.g. POLLEN_HTTP_PORT or POLLEN_LIMITS_READ_SIZE.
+// Empty variables are ignored and unknown ones are an error, except that an
+// empty POLLEN_HTTP_PORT or POLLEN_HTTPS_PORT disables that listener, as an
+// empty port flag does and HTTP_PORT and HTTPS_PORT in /etc/default/pollen
+// used to.
+func (c *Config) applyEnv(environ []string) error {
+	keys := make(map[string]string)
+	for _, k := range c.keys() {
+		keys[envPrefix+strings.ToUpper(strings.ReplaceAll(k, ".", "_"))] = k
+	}
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		k, ok := keys[name]
+		if value == "" {
+			if k == "http.port" || k == "https.port" {
+				c.set(strings.TrimSuffix(k, ".port")+".enabled", "false")
+			}
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("unknown environment variable %s", name)
+		}
+		if err := c.set(k, value); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// applyFlag sets the configuration key for the named command line flag. An
+// empty port disables that listener.
+func (c *Config) applyFlag(name, value string) error {
+	k, ok := flagKeys[name]
+	if !ok {
+		return nil
+	}
+	if section, ok := strings.CutSuffix(k, ".port"); ok {
+		if value == "" {
+			return c.set(section+".enabled", "false")
+		}
+		if err := c.set(section+".enabled", "true"); err != nil {
+			return err
+		}
+	}
+	if err := c.set(k, value); err != nil {
+		return fmt.Errorf("-%s: %s", name, err)
+	}
+	return nil
+}
+
+// keys lists every scalar configuration key in dotted form.
+func (c *Config) keys() []string {
+	var keys []string
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := prefix + yamlName(f)
+			switch {
+			case f.Type.Kind() == reflect.Struct:
+				walk(f.Type, name+".")
+			case isScalar(f.Type):
+				keys = append(keys, name)
+			}
+		}
+	}
+	walk(reflect.TypeOf(c).Elem(), "")
+	return keys
+}
+
+// set parses value into the configuration key given in dotted form.
+func (c *Config) set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, part := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown configuration key %q", key)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if yamlName(v.Type().Field(i)) == part {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown configuration key %q", key)
+		}
+	}
+	return setScalar(v, value)
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+func setScalar(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean value %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer value %q", value)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				items = append(items, s)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot set a %s from a string", v.Type())
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Validate checks the configuration for mistakes that would otherwise only
+// show up once pollen is running.
+func (c *Config) Validate() error {
+	if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+		return fmt.Errorf("invalid TLS minimum version %q", c.TLS.MinVersion)
+	}
+	if err := c.validateListeners(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(c.Source.Device)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device", c.Source.Device)
+	}
+	if c.Source.SampleInterval <= 0 {
+		return fmt.Errorf("invalid source sample interval: %s", c.Source.SampleInterval)
+	}
+	if c.Source.CRNGTimeout < 0 {
+		return fmt.Errorf("invalid source crng_timeout: %s", c.Source.CRNGTimeout)
+	}
+	if c.Limits.ReadSize <= 0 {
+		return fmt.Errorf("invalid read size: %d", c.Limits.ReadSize)
+	}
+	if c.Limits.MaxInFlight < 0 || c.Limits.MaxQueued < 0 || c.Limits.QueueTimeout < 0 {
+		return fmt.Errorf("concurrency limits must not be negative")
+	}
+	if err := c.validateMetrics(); err != nil {
+		return err
+	}
+	if err := c.Metrics.Histograms.validate(); err != nil {
+		return err
+	}
+	if err := c.Log.validate(); err != nil {
+		return err
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+	if err := c.validateDebug(); err != nil {
+		return err
+	}
+	if _, err := c.adminUIDs(); err != nil {
+		return err
+	}
+	if err := c.Maintenance.validate(); err != nil {
+		return err
+	}
+	if err := c.Server.validate(); err != nil {
+		return err
+	}
+	if _, err := parseCIDRs(c.Proxy.Trusted); err != nil {
+		return fmt.Errorf("invalid trusted proxy: %s", err)
+	}
+	if _, err := c.accessControl(); err != nil {
+		return err
+	}
+	if err := c.Limits.RateLimit.validate(); err != nil {
+		return err
+	}
+	if c.Privileges.User != "" {
+		if _, err := user.Lookup(c.Privileges.User); err != nil {
+			return err
+		}
+	} else if c.Privileges.Group != "" {
+		return errors.New("a group can only be given together with a user")
+	}
+	if c.Privileges.Group != "" {
+		if _, err := user.LookupGroup(c.Privileges.Group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configMain implements the "pollen config" subcommand, which takes the same
+// flags as the server. "pollen config check" reports whether the resulting
+// configuration is valid, and "pollen config sockets" prints the pollen.socket
+// drop-in for its TCP listeners.
+func configMain(args []string) {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "sockets") {
+		fatal("Usage: pollen config check|sockets [-config path] [flags]")
+	}
+	flag.CommandLine.Parse(args[1:])
+	if args[0] == "sockets" {
+		// run by the generator as systemd starts, before users can be looked
+		// up, so the rest of the configuration is left to check
+		cfg, err := readConfig()
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Print(cfg.socketUnit())
+		return
+	}
+	if _, err := loadConfig(); err != nil {
+		fatal(err)
+	}
+	fmt.Println("Configuration OK")
+}
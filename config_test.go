@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "pollen.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestConfigFile checks that the YAML file overrides the defaults and that
+// unknown keys are rejected.
+func TestConfigFile(t *testing.T) {
+	cfg := defaultConfig()
+	path := writeConfig(t, "http:\n  port: 8080\nhttps:\n  enabled: false\nlimits:\n  read_size: 32\n")
+	if err := cfg.loadFile(path); err != nil {
+		t.Fatalf("loadFile failed: %s", err)
+	}
+	if cfg.HTTP.Port != 8080 || !cfg.HTTP.Enabled || cfg.HTTPS.Enabled || cfg.Limits.ReadSize != 32 {
+		t.Errorf("configuration not applied: %+v", cfg)
+	}
+	if cfg.Source.Device != "/dev/random" {
+		t.Errorf("default device lost, got: %s", cfg.Source.Device)
+	}
+
+	path = writeConfig(t, "http:\n  prot: 8080\n")
+	if err := defaultConfig().loadFile(path); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("expected an unknown key error, got: %v", err)
+	}
+	path = writeConfig(t, "metrics:\n  enabled: yes please\n")
+	if err := defaultConfig().loadFile(path); err == nil {
+		t.Error("expected an invalid boolean error")
+	}
+}
+
+// TestConfigEnv checks the POLLEN_* environment overrides.
+func TestConfigEnv(t *testing.T) {
+	cfg := defaultConfig()
+	err := cfg.applyEnv([]string{
+		"PATH=/usr/bin",
+		"POLLEN_HTTP_PORT=8080",
+		"POLLEN_LIMITS_READ_SIZE=128",
+		"POLLEN_TLS_AUTOGEN=true",
+		"POLLEN_SOURCE_DEVICE=",
+	})
+	if err != nil {
+		t.Fatalf("applyEnv failed: %s", err)
+	}
+	if cfg.HTTP.Port != 8080 || cfg.Limits.ReadSize != 128 || !cfg.TLS.Autogen {
+		t.Errorf("environment not applied: %+v", cfg)
+	}
+	if cfg.Source.Device != "/dev/random" {
+		t.Errorf("empty variable should be ignored, got device: %q", cfg.Source.Device)
+	}
+	if err := defaultConfig().applyEnv([]string{"POLLEN_HTTP_PROT=80"}); err == nil {
+		t.Error("expected an unknown variable error")
+	}
+	if err := defaultConfig().applyEnv([]string{"POLLEN_HTTP_PORT=eighty"}); err == nil {
+		t.Error("expected an invalid integer error")
+	}
+}
+
+// TestConfigDefaultFile runs an /etc/default/pollen from before the POLLEN_*
+// variables through the rename in the package's postinst, and checks that
+// the listeners it disabled stay disabled.
+func TestConfigDefaultFile(t *testing.T) {
+	postinst, err := os.ReadFile("debian/pollen.postinst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sed command, from its first line to the file it edits
+	script := string(postinst)
+	start := strings.Index(script, "sed -i.dpkg-old")
+	end := strings.Index(script, `"$DEFAULT"`+"\n")
+	if start < 0 || end < start {
+		t.Fatal("no rename found in postinst")
+	}
+	script = script[start : end+len(`"$DEFAULT"`)]
+	path := filepath.Join(t.TempDir(), "pollen")
+	old := "HTTP_PORT=\"\"\nHTTPS_PORT=\"8443\"\nDEVICE=\"/dev/urandom\"\nBYTES=\"32\"\nCERT=\"/etc/pollen/cert.pem\"\nKEY=\"/etc/pollen/key.pem\"\n"
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "DEFAULT="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("rename failed: %s\n%s", err, out)
+	}
+	renamed, _ := os.ReadFile(path)
+	// as systemd's EnvironmentFile= reads it
+	for _, line := range strings.Split(strings.TrimSpace(string(renamed)), "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		t.Setenv(name, strings.Trim(value, `"`))
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		t.Fatalf("readConfig failed: %s", err)
+	}
+	if cfg.HTTP.Enabled || !cfg.HTTPS.Enabled || cfg.HTTPS.Port != 8443 || cfg.Source.Device != "/dev/urandom" || cfg.Limits.ReadSize != 32 {
+		t.Errorf("old settings not kept: %+v", cfg)
+	}
+}
+
+// TestConfigFlags checks that an empty port flag disables the listener as it
+// always has.
+func TestConfigFlags(t *testing.T) {
+	cfg := defaultConfig()
+	for name, value := range map[string]string{"http-port": "", "metrics-port": "9090", "bytes": "16"} {
+		if err := cfg.applyFlag(name, value); err != nil {
+			t.Fatalf("applyFlag(%s) failed: %s", name, err)
+		}
+	}
+	if cfg.HTTP.Enabled || !cfg.Metrics.Enabled || cfg.Metrics.Port != 9090 || cfg.Limits.ReadSize != 16 {
+		t.Errorf("flags not applied: %+v", cfg)
+	}
+}
+
+// TestConfigValidate covers the checks the packaging used to do in shell.
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := defaultConfig()
+		cfg.HTTPS.Enabled = false
+		cfg.Source.Device = "/dev/urandom"
+		return cfg
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for name, mutate := range map[string]func(*Config){
+		"nothing to do":  func(c *Config) { c.HTTP.Enabled = false },
+		"bad port":       func(c *Config) { c.HTTP.Port = 65536 },
+		"duplicate port": func(c *Config) { c.Metrics.Enabled, c.Metrics.Port = true, 80 },
+		"missing cert":   func(c *Config) { c.HTTPS.Enabled, c.TLS.Cert = true, "/nonexistent/cert.pem" },
+		"tls version":    func(c *Config) { c.TLS.MinVersion = "2.0" },
+		"not a device":   func(c *Config) { c.Source.Device = os.TempDir() },
+		"read size":      func(c *Config) { c.Limits.ReadSize = 0 },
+		"queue limit":    func(c *Config) { c.Limits.MaxQueued = -1 },
+		"trusted proxy":  func(c *Config) { c.Proxy.Trusted = []string{"10.0.0.0/33"} },
+		"proxy protocol": func(c *Config) {
+			c.Listeners = []ListenerSpec{{Name: "lb", Address: ":8080", ProxyProtocol: true}}
+		},
+	} {
+		cfg := valid()
+		mutate(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+	cfg := valid()
+	cfg.HTTPS.Enabled, cfg.TLS.Cert, cfg.TLS.Autogen = true, "/nonexistent/cert.pem", true
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("missing cert should be allowed with autogen, got: %s", err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type DebugConfig struct {
+	// Enabled serves pprof and expvar on a listener of their own
+	Enabled bool `yaml:"enabled"`
+	// Address is the debug listener's host:port, which must be a loopback
+	// address unless Allow is given
+	Address string `yaml:"address"`
+	// Allow lists access_lists names or CIDRs of the clients the debug
+	// endpoints are served to
+	Allow []string `yaml:"allow"`
+}
+
+// debugListener is the name of the debug listener, under which debug.allow
+// is kept with the listeners' access control.
+const debugListener = "debug"
+
+// redacted replaces secrets in the configuration shown by the debug
+// listener.
+const redacted = "REDACTED"
+
+// debugSpec returns the debug listener, if it is enabled.
+func (c *Config) debugSpec() (ListenerSpec, bool) {
+	if !c.Debug.Enabled {
+		return ListenerSpec{}, false
+	}
+	return ListenerSpec{Name: debugListener, Network: "tcp", Address: c.Debug.Address, Scheme: "http"}, true
+}
+
+// validateDebug keeps the debug endpoints to the local host, unless who else
+// may see them is spelled out.
+func (c *Config) validateDebug() error {
+	if !c.Debug.Enabled || len(c.Debug.Allow) > 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(c.Debug.Address)
+	if err != nil {
+		return fmt.Errorf("debug address: %s", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("a debug address other than the loopback needs debug.allow")
+	}
+	return nil
+}
+
+// redactedConfig returns the configuration as it is written in YAML, with
+// the credentials in URLs and any password, token or secret replaced.
+func (c *Config) redactedConfig() any {
+	var tree any
+	b, err := yaml.Marshal(c)
+	if err == nil {
+		err = yaml.Unmarshal(b, &tree)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return redact(tree)
+}
+
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			secret := strings.Contains(k, "password") || strings.Contains(k, "token") || strings.Contains(k, "secret")
+			if secret && !strings.HasSuffix(k, "_file") && item != nil && item != "" {
+				v[k] = redacted
+			} else {
+				v[k] = redact(item)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redact(item)
+		}
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+	}
+	return v
+}
+
+// len and cap return how full the queue is. If the logQueue receiver is nil,
+// they return 0.
+func (q *logQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.records)
+}
+
+func (q *logQueue) cap() int {
+	if q == nil {
+		return 0
+	}
+	return cap(q.records)
+}
+
+// buffered returns the spans waiting to be exported and the most that can.
+// If the Tracer receiver is nil, it returns 0.
+func (t *Tracer) buffered() (int, int) {
+	if t == nil {
+		return 0, 0
+	}
+	return len(t.spans), cap(t.spans)
+}
+
+// counts returns the requests in flight and queued. If the
+// ConcurrencyLimiter receiver is nil, it returns 0.
+func (c *ConcurrencyLimiter) counts() (int, int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight, c.queued
+}
+
+// debugVars returns pollen's own expvar variables, computed whenever they
+// are served.
+func (p *PollenServer) debugVars(cfg *Config) map[string]expvar.Var {
+	config := cfg.redactedConfig()
+	return map[string]expvar.Var{
+		"config":     expvar.Func(func() any { return config }),
+		"goroutines": expvar.Func(func() any { return runtime.NumGoroutine() }),
+		"source": expvar.Func(func() any {
+			stats := p.entropy.Stats()
+			inFlight, queued := p.concurrency.counts()
+			return map[string]any{
+				"device":                 cfg.Source.Device,
+				"read_size":              p.readSize.Load(),
+				"starting":               p.starting.Load(),
+				"entropy_avail":          stats.EntropyAvail,
+				"poolsize":               stats.PoolSize,
+				"write_wakeup_threshold": stats.WriteWakeupThreshold,
+				"crng_ready":             stats.CRNGReady,
+				"requests_in_flight":     inFlight,
+				"requests_queued":        queued,
+			}
+		}),
+		"buffers": expvar.Func(func() any {
+			spans, spansCap := p.tracer.buffered()
+			return map[string]any{
+				"log":     map[string]any{"length": p.logQueue.len(), "capacity": p.logQueue.cap(), "dropped": p.logQueue.Dropped()},
+				"tracing": map[string]any{"length": spans, "capacity": spansCap},
+			}
+		}),
+	}
+}
+
+// serveVars serves the process-wide expvar variables, such as memstats,
+// together with pollen's own, in the format of expvar.Handler. Pollen's are
+// not published, so that there can be more than one PollenServer.
+func serveVars(vars map[string]expvar.Var) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		first := true
+		write := func(kv expvar.KeyValue) {
+			if !first {
+				fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		}
+		expvar.Do(write)
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			write(expvar.KeyValue{Key: name, Value: vars[name]})
+		}
+		fmt.Fprintf(w, "\n}\n")
+	}
+}
+
+// debugHandler returns the handler for the debug listener: pprof under
+// /debug/pprof/ and the variables on /debug/vars, to the clients
+// debug.allow lets in.
+func (p *PollenServer) debugHandler(cfg *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", serveVars(p.debugVars(cfg)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerKey{}, debugListener)
+		r = withClientAddr(r.WithContext(ctx), p.trustedProxies)
+		if list := p.acls.Load().check(debugListener, clientIP(r)); list != "" {
+			p.denied(w, r, debugListener, list)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// kernelRandomDir holds the kernel's random pool statistics, a variable so
+// that tests can stand in for the kernel.
+var kernelRandomDir = "/proc/sys/kernel/random"
+
+// poolStats is the state of the kernel's random pool. Values that could not
+// be read are -1.
+type poolStats struct {
+	EntropyAvail         int
+	PoolSize             int
+	WriteWakeupThreshold int
+	// CRNGReady is whether the kernel's CRNG has been seeded, so that reads
+	// of /dev/urandom no longer risk being predictable
+	CRNGReady bool
+}
+
+// EntropySampler reads the kernel's random pool statistics in the
+// background, so that requests never wait on them.
+type EntropySampler struct {
+	dir     string
+	tracker *Tracker
+	log     *slog.Logger
+	stats   atomic.Pointer[poolStats]
+}
+
+// NewEntropySampler samples the pool once, then every interval.
+func NewEntropySampler(interval time.Duration, tracker *Tracker, log *slog.Logger) *EntropySampler {
+	s := &EntropySampler{dir: kernelRandomDir, tracker: tracker, log: log}
+	s.sample()
+	go func() {
+		for range time.Tick(interval) {
+			s.sample()
+		}
+	}()
+	return s
+}
+
+// readPoolValue reads one of the integers in dir, or -1 if it can't.
+func readPoolValue(dir, name string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return -1, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return -1, err
+	}
+	return n, nil
+}
+
+// sample reads the statistics and exports them as metrics.
+func (s *EntropySampler) sample() {
+	stats := &poolStats{CRNGReady: crngReady()}
+	for _, v := range []struct {
+		name  string
+		value *int
+	}{
+		{"entropy_avail", &stats.EntropyAvail},
+		{"poolsize", &stats.PoolSize},
+		{"write_wakeup_threshold", &stats.WriteWakeupThreshold},
+	} {
+		var err error
+		if *v.value, err = readPoolValue(s.dir, v.name); err != nil {
+			s.log.Debug("Cannot read random pool statistics", "name", v.name, "error", err)
+		}
+	}
+	s.stats.Store(stats)
+	s.tracker.PoolStats(*stats)
+}
+
+// Stats returns the latest statistics. If the EntropySampler receiver is
+// nil, every value is unknown.
+func (s *EntropySampler) Stats() poolStats {
+	if s == nil {
+		return poolStats{EntropyAvail: -1, PoolSize: -1, WriteWakeupThreshold: -1}
+	}
+	return *s.stats.Load()
+}
+
+// EntropyAvail returns the latest entropy_avail as it is logged, "?" if it
+// is unknown.
+func (s *EntropySampler) EntropyAvail() string {
+	if avail := s.Stats().EntropyAvail; avail >= 0 {
+		return strconv.Itoa(avail)
+	}
+	return "?"
+}
@@ -0,0 +1,15 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// crngReady asks getrandom for a byte without blocking, which fails with
+// EAGAIN until the CRNG is seeded.
+func crngReady() bool {
+	var b [1]byte
+	for {
+		_, err := unix.Getrandom(b[:], unix.GRND_NONBLOCK)
+		if err != unix.EINTR {
+			return err == nil
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// crngReady assumes the system's random source is always seeded where
+// getrandom is not available.
+func crngReady() bool {
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestEntropySampler reads pool statistics, with the trailing newlines the
+// kernel writes, and checks they are exported.
+func TestEntropySampler(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "entropy_avail"), []byte("256\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "poolsize"), []byte("256\n"), 0644)
+	reg := prometheus.NewRegistry()
+	s := &EntropySampler{dir: dir, tracker: NewTracker(reg, HistogramsConfig{}), log: slog.Default()}
+	s.sample()
+
+	stats := s.Stats()
+	if stats.EntropyAvail != 256 || stats.PoolSize != 256 || stats.WriteWakeupThreshold != -1 || !stats.CRNGReady {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if avail := s.EntropyAvail(); avail != "256" {
+		t.Errorf("unexpected entropy_avail: %s", avail)
+	}
+	for name, want := range map[string]float64{
+		"pollen_system_entropy":                        256,
+		"pollen_system_entropy_poolsize":               256,
+		"pollen_system_entropy_write_wakeup_threshold": 0,
+		"pollen_system_crng_ready":                     1,
+	} {
+		if got := gathered(t, reg, name, nil); got != want {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, "entropy_avail"), []byte("garbage\n"), 0644)
+	s.sample()
+	if avail := s.EntropyAvail(); avail != "?" {
+		t.Errorf("unexpected entropy_avail: %s", avail)
+	}
+	if got := gathered(t, reg, "pollen_system_entropy", nil); got != 256 {
+		t.Errorf("unknown value exported: %v", got)
+	}
+	var nilSampler *EntropySampler
+	if avail := nilSampler.EntropyAvail(); avail != "?" {
+		t.Errorf("unexpected entropy_avail without a sampler: %s", avail)
+	}
+}
+
+// TestKernelPoolStats reads the real kernel's statistics.
+func TestKernelPoolStats(t *testing.T) {
+	if _, err := os.Stat(kernelRandomDir); err != nil {
+		t.Skip("no kernel random pool statistics")
+	}
+	s := &EntropySampler{dir: kernelRandomDir, log: slog.Default()}
+	s.sample()
+	if stats := s.Stats(); stats.EntropyAvail < 0 || stats.PoolSize <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
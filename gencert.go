@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certOptions describes the self-signed certificate generated by gencert and
+// by -https-autogen.
+type certOptions struct {
+	// keyType is either "ecdsa" (P-256) or "ed25519"
+	keyType  string
+	hosts    []string
+	lifetime time.Duration
+}
+
+// defaultCertOptions returns the options used by -https-autogen: an ECDSA key
+// valid for ten years, for localhost and the local hostname.
+func defaultCertOptions() certOptions {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil && name != "" && name != "localhost" {
+		hosts = append(hosts, name)
+	}
+	return certOptions{keyType: "ecdsa", hosts: hosts, lifetime: 3650 * 24 * time.Hour}
+}
+
+// generateCert creates a self-signed certificate and private key, both PEM
+// encoded, along with the SPKI pin of the public key.
+func generateCert(opts certOptions) (certPEM, keyPEM []byte, pin string, err error) {
+	var priv crypto.Signer
+	switch opts.keyType {
+	case "ecdsa":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unknown key type %q, expected ecdsa or ed25519", opts.keyType)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(opts.hosts) == 0 {
+		return nil, nil, "", errors.New("at least one host name or address is required")
+	}
+	if opts.lifetime <= 0 {
+		return nil, nil, "", errors.New("certificate lifetime must be positive")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: opts.hosts[0], Organization: []string{"pollen"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(opts.lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range opts.hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	pin, err = spkiPin(priv.Public())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, pin, nil
+}
+
+// spkiPin returns the public key pin in the form accepted by curl's
+// --pinnedpubkey, which is what pollinate uses to pin a server.
+func spkiPin(pub crypto.PublicKey) (string, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(spki)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so that a reader never sees a partially written key.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(perm); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeCert generates a certificate and key and writes them to certPath and
+// keyPath. The key is only readable by its owner. Existing files are left
+// alone unless overwrite is set.
+func writeCert(certPath, keyPath string, opts certOptions, overwrite bool) (pin string, err error) {
+	if !overwrite {
+		for _, p := range []string{certPath, keyPath} {
+			if _, err := os.Stat(p); err == nil {
+				return "", fmt.Errorf("%s already exists", p)
+			}
+		}
+	}
+	certPEM, keyPEM, pin, err := generateCert(opts)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return "", err
+		}
+	}
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(certPath, certPEM, 0644); err != nil {
+		return "", err
+	}
+	return pin, nil
+}
+
+// autogenCert creates the certificate and key if either of them is missing.
+// It returns the SPKI pin of the new key, or "" if nothing was generated.
+func autogenCert(certPath, keyPath string) (string, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return "", nil
+	}
+	return writeCert(certPath, keyPath, defaultCertOptions(), true)
+}
+
+// gencertMain implements the "pollen gencert" subcommand.
+func gencertMain(args []string) {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	certPath := fs.String("cert", "/etc/pollen/cert.pem", "The full path to write cert.pem")
+	keyPath := fs.String("key", "/etc/pollen/key.pem", "The full path to write key.pem")
+	keyType := fs.String("type", "ecdsa", "The key type, ecdsa or ed25519")
+	hosts := fs.String("hosts", strings.Join(defaultCertOptions().hosts, ","), "Comma separated host names and IP addresses for the certificate")
+	days := fs.Int("days", 3650, "The number of days the certificate is valid for")
+	force := fs.Bool("force", false, "Overwrite an existing cert.pem and key.pem")
+	fs.Parse(args)
+
+	opts := certOptions{keyType: *keyType, lifetime: time.Duration(*days) * 24 * time.Hour}
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			opts.hosts = append(opts.hosts, h)
+		}
+	}
+	pin, err := writeCert(*certPath, *keyPath, opts, *force)
+	if err != nil {
+		fatalf("Cannot generate certificate: %s\n", err)
+	}
+	fmt.Printf("Wrote %s and %s\nSPKI pin: %s\n", *certPath, *keyPath, pin)
+}
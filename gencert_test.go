@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestGenerateCert checks that both key types produce a usable key pair with
+// the requested SANs and a pin matching the certificate's public key.
+func TestGenerateCert(t *testing.T) {
+	for _, keyType := range []string{"ecdsa", "ed25519"} {
+		opts := certOptions{keyType: keyType, hosts: []string{"pollen.example.com", "192.0.2.1"}, lifetime: 24 * time.Hour}
+		certPEM, keyPEM, pin, err := generateCert(opts)
+		if err != nil {
+			t.Fatalf("%s: generateCert failed: %s", keyType, err)
+		}
+		if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			t.Errorf("%s: cert and key do not match: %s", keyType, err)
+		}
+		block, _ := pem.Decode(certPEM)
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: cannot parse certificate: %s", keyType, err)
+		}
+		if len(c.DNSNames) != 1 || c.DNSNames[0] != "pollen.example.com" {
+			t.Errorf("%s: wrong DNS SANs: %v", keyType, c.DNSNames)
+		}
+		if len(c.IPAddresses) != 1 || c.IPAddresses[0].String() != "192.0.2.1" {
+			t.Errorf("%s: wrong IP SANs: %v", keyType, c.IPAddresses)
+		}
+		if c.NotAfter.Sub(c.NotBefore) != 24*time.Hour {
+			t.Errorf("%s: wrong lifetime: %s", keyType, c.NotAfter.Sub(c.NotBefore))
+		}
+		expected, _ := spkiPin(c.PublicKey)
+		if pin != expected {
+			t.Errorf("%s: pin mismatch, expected: %s, got: %s", keyType, expected, pin)
+		}
+	}
+	if _, _, _, err := generateCert(certOptions{keyType: "rsa", hosts: []string{"localhost"}, lifetime: time.Hour}); err == nil {
+		t.Error("expected an error for an unknown key type")
+	}
+}
+
+// TestWriteCert checks file permissions and that existing files are only
+// replaced when asked to.
+func TestWriteCert(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	opts := certOptions{keyType: "ecdsa", hosts: []string{"localhost"}, lifetime: time.Hour}
+
+	if _, err := writeCert(certPath, keyPath, opts, false); err != nil {
+		t.Fatalf("writeCert failed: %s", err)
+	}
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key has wrong permissions: %v %v", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(certPath); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("cert has wrong permissions: %v %v", fi.Mode(), err)
+	}
+	if _, err := writeCert(certPath, keyPath, opts, false); err == nil {
+		t.Error("expected writeCert to refuse to overwrite existing files")
+	}
+	if _, err := writeCert(certPath, keyPath, opts, true); err != nil {
+		t.Errorf("writeCert failed to overwrite: %s", err)
+	}
+
+	pin, err := autogenCert(certPath, keyPath)
+	if err != nil || pin != "" {
+		t.Errorf("autogenCert replaced existing files, pin: %q err: %v", pin, err)
+	}
+	os.Remove(keyPath)
+	pin, err = autogenCert(certPath, keyPath)
+	if err != nil || pin == "" {
+		t.Errorf("autogenCert did not regenerate a missing key, pin: %q err: %v", pin, err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// ListenerSpec describes one socket pollen serves on. When no listeners are
+// configured they are derived from the http and https sections.
+type ListenerSpec struct {
+	// Name identifies the listener in logs and labels its metrics
+	Name string `yaml:"name"`
+	// Network is tcp for dual-stack, tcp4 for IPv4 only, tcp6 for IPv6 only,
+	// unix for a Unix domain socket or systemd for a socket passed by systemd
+	Network string `yaml:"network"`
+	// Address is host:port, an empty host binds every interface. For unix it
+	// is the socket path and for systemd the socket's FileDescriptorName.
+	Address string `yaml:"address"`
+	// Mode and Group set the permissions of a unix socket, e.g. "0660"
+	Mode  string `yaml:"mode"`
+	Group string `yaml:"group"`
+	// Scheme is http or https
+	Scheme string `yaml:"scheme"`
+	// TLSProfile names an entry in tls_profiles, the tls section is used if empty
+	TLSProfile string `yaml:"tls_profile"`
+	// Routes lists the routes served, all of them if empty
+	Routes []string `yaml:"routes"`
+	// ProxyProtocol requires a PROXY protocol v1 or v2 header from a trusted
+	// proxy at the start of every connection
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// Allow and Deny list access_lists names or CIDRs the listener allows
+	// or denies, see listenerACL
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// routePaths maps the route names usable in ListenerSpec.Routes to the paths
+// they are served on.
+var routePaths = map[string]string{
+	"entropy": "/",
+	"health":  "/healthz",
+	"ready":   "/readyz",
+}
+
+// listeners returns the listeners to open, with defaults filled in.
+func (c *Config) listeners() []ListenerSpec {
+	var specs []ListenerSpec
+	if len(c.Listeners) > 0 {
+		specs = append(specs, c.Listeners...)
+	} else {
+		if c.HTTP.Enabled {
+			specs = append(specs, ListenerSpec{Name: "http", Address: fmt.Sprintf(":%d", c.HTTP.Port), Scheme: "http"})
+		}
+		if c.HTTPS.Enabled {
+			specs = append(specs, ListenerSpec{Name: "https", Address: fmt.Sprintf(":%d", c.HTTPS.Port), Scheme: "https"})
+		}
+	}
+	for i := range specs {
+		if specs[i].Network == "" {
+			specs[i].Network = "tcp"
+		}
+		if specs[i].Scheme == "" {
+			specs[i].Scheme = "http"
+		}
+		if len(specs[i].Routes) == 0 {
+			for r := range routePaths {
+				specs[i].Routes = append(specs[i].Routes, r)
+			}
+		}
+	}
+	return specs
+}
+
+// tlsProfile returns the named TLS profile, "" being the tls section. A
+// profile without a minimum version inherits the one in the tls section.
+func (c *Config) tlsProfile(name string) (TLSConfig, bool) {
+	if name == "" {
+		return c.TLS, true
+	}
+	p, ok := c.TLSProfiles[name]
+	if p.MinVersion == "" {
+		p.MinVersion = c.TLS.MinVersion
+	}
+	return p, ok
+}
+
+// validateListeners checks the listener specs and that no two sockets,
+// including the metrics one, would be bound to the same port.
+func (c *Config) validateListeners() error {
+	if len(c.listeners()) == 0 {
+		return fmt.Errorf("Nothing to do if http and https are both disabled")
+	}
+	specs := c.servedSpecs()
+	type bound struct {
+		name   string
+		host   string
+		family string
+	}
+	ports := make(map[int][]bound)
+	names := make(map[string]bool)
+	for _, l := range specs {
+		if l.Name == "" {
+			return fmt.Errorf("listener %s has no name", l.Address)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener name %s is not unique", l.Name)
+		}
+		names[l.Name] = true
+		switch l.Network {
+		case "tcp", "tcp4", "tcp6":
+		case "unix":
+			if !filepath.IsAbs(l.Address) {
+				return fmt.Errorf("listener %s: unix socket path must be absolute", l.Name)
+			}
+			if _, err := l.socketMode(); err != nil {
+				return fmt.Errorf("listener %s: %s", l.Name, err)
+			}
+		case "systemd":
+			if l.Address == "" {
+				return fmt.Errorf("listener %s: no FileDescriptorName given", l.Name)
+			}
+		default:
+			return fmt.Errorf("listener %s: unknown network %q", l.Name, l.Network)
+		}
+		if err := c.validateScheme(l); err != nil {
+			return err
+		}
+		if l.ProxyProtocol && l.Network != "unix" && len(c.Proxy.Trusted) == 0 {
+			return fmt.Errorf("listener %s: proxy_protocol needs proxy.trusted", l.Name)
+		}
+		if l.Network == "unix" || l.Network == "systemd" {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			return fmt.Errorf("listener %s: %s", l.Name, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid %s port number: %s", l.Name, portStr)
+		}
+		family := ipFamily(l.Network, host)
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			host = ""
+		}
+		for _, b := range ports[port] {
+			sameFamily := b.family == "" || family == "" || b.family == family
+			if sameFamily && (b.host == host || b.host == "" || host == "") {
+				return fmt.Errorf("%s and %s ports must be unique", b.name, l.Name)
+			}
+		}
+		ports[port] = append(ports[port], bound{l.Name, host, family})
+	}
+	return nil
+}
+
+// ipFamily returns the IP version a TCP listener binds, "4" or "6", or ""
+// for both. An address's own version wins, but a tcp4 or tcp6 wildcard only
+// binds its network's version, which leaves the port free for the other,
+// while a tcp wildcard is dual-stack.
+func ipFamily(network, host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && !ip.IsUnspecified() && ip.To4() != nil:
+		return "4"
+	case ip != nil && !ip.IsUnspecified():
+		return "6"
+	case network == "tcp4":
+		return "4"
+	case network == "tcp6":
+		return "6"
+	}
+	return ""
+}
+
+// validateScheme checks the scheme, TLS profile and routes of a listener.
+func (c *Config) validateScheme(l ListenerSpec) error {
+	if l.Scheme == "" {
+		// the metrics listener
+		return nil
+	}
+	switch l.Scheme {
+	case "http":
+	case "https":
+		p, ok := c.tlsProfile(l.TLSProfile)
+		if !ok {
+			return fmt.Errorf("listener %s: unknown tls profile %q", l.Name, l.TLSProfile)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("cannot enable https on %s: %s", l.Name, err)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown scheme %q", l.Name, l.Scheme)
+	}
+	for _, r := range l.Routes {
+		if _, ok := routePaths[r]; !ok {
+			return fmt.Errorf("listener %s: unknown route %q", l.Name, r)
+		}
+	}
+	return nil
+}
+
+// socketMode parses Mode, defaulting to 0660.
+func (l ListenerSpec) socketMode() (os.FileMode, error) {
+	if l.Mode == "" {
+		return 0660, nil
+	}
+	m, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", l.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// openListener binds the socket for a listener. A TCP listener whose address
+// matches a socket passed by systemd takes that socket instead of binding.
+func openListener(l ListenerSpec) (net.Listener, error) {
+	switch l.Network {
+	case "systemd":
+		return activatedListener(l.Address)
+	case "unix":
+		return openUnixListener(l)
+	}
+	if ln, ok := inheritedListener(l.Network, l.Address); ok {
+		return ln, nil
+	}
+	return net.Listen(l.Network, l.Address)
+}
+
+// openUnixListener creates a Unix domain socket with the configured
+// permissions, replacing a stale socket left behind by a previous run.
+func openUnixListener(l ListenerSpec) (net.Listener, error) {
+	mode, err := l.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(l.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(l.Address)
+	}
+	ln, err := net.Listen("unix", l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(l.Address, mode); err == nil && l.Group != "" {
+		var g *user.Group
+		if g, err = user.LookupGroup(l.Group); err == nil {
+			gid, _ := strconv.Atoi(g.Gid)
+			err = os.Chown(l.Address, -1, gid)
+		}
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// validate checks the TLS profile's version and that its certificate and key
+// exist, unless they are to be generated.
+func (t TLSConfig) validate() error {
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		return fmt.Errorf("invalid TLS minimum version %q", t.MinVersion)
+	}
+	if t.Autogen {
+		return nil
+	}
+	for _, p := range []string{t.Cert, t.Key} {
+		if _, err := os.Stat(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certificate holds a profile's certificate and key, replaced as a whole
+// when they are reloaded.
+type certificate struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// load reads the certificate and key, keeping the ones served so far if
+// they can't be read.
+func (c *certificate) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// serverConfig loads the profile's certificate into a tls.Config, so that
+// the key is read before pollen gives up any privileges. The certificate is
+// returned too, to be reloaded.
+func (t TLSConfig) serverConfig() (*tls.Config, *certificate, error) {
+	c := &certificate{certFile: t.Cert, keyFile: t.Key}
+	if err := c.load(); err != nil {
+		return nil, nil, err
+	}
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return c.cert.Load(), nil
+	}
+	return &tls.Config{MinVersion: tlsVersions[t.MinVersion], GetCertificate: getCertificate}, c, nil
+}
+
+type listenerKey struct{}
+
+// listenerName returns the name of the listener a request arrived on.
+func listenerName(ctx context.Context) string {
+	name, _ := ctx.Value(listenerKey{}).(string)
+	return name
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID a request is logged with.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random ID to tie together what is logged about a
+// request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// listenerHandler returns the handler for a listener, serving only its
+// routes to the clients its access control allows, with the listener name,
+// the request ID and trace context and the client address in the context,
+// writing the access log and tracing the request. The request ID is returned
+// in the X-Request-ID header.
+func (p *PollenServer) listenerHandler(spec ListenerSpec) http.Handler {
+	mux := http.NewServeMux()
+	for _, r := range spec.Routes {
+		switch r {
+		case "entropy":
+			mux.Handle(routePaths[r], p)
+		case "health":
+			mux.HandleFunc(routePaths[r], p.serveHealth)
+		case "ready":
+			mux.HandleFunc(routePaths[r], p.serveReady)
+		}
+	}
+	if p.mountsMetrics(spec.Name) {
+		mux.Handle(p.metricsPath, p.metricsHandler())
+	}
+	h := p.tracer.traced(p.accessLog.accessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if list := p.acls.Load().check(spec.Name, clientIP(r)); list != "" {
+			p.denied(w, r, spec.Name, list)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withTraceContext(r.WithContext(context.WithValue(r.Context(), listenerKey{}, spec.Name)))
+		w.Header().Set("X-Request-ID", requestID(r.Context()))
+		h.ServeHTTP(w, withClientAddr(r, p.trustedProxies))
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestLegacyListeners checks that the http and https sections still describe
+// the listeners when no listeners are configured.
+func TestLegacyListeners(t *testing.T) {
+	cfg := defaultConfig()
+	specs := cfg.listeners()
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 listeners, got: %v", specs)
+	}
+	if specs[0].Name != "http" || specs[0].Address != ":80" || specs[0].Scheme != "http" || specs[0].Network != "tcp" {
+		t.Errorf("wrong http listener: %+v", specs[0])
+	}
+	if specs[1].Name != "https" || specs[1].Address != ":443" || specs[1].Scheme != "https" {
+		t.Errorf("wrong https listener: %+v", specs[1])
+	}
+	if len(specs[0].Routes) != len(routePaths) {
+		t.Errorf("expected every route to be served, got: %v", specs[0].Routes)
+	}
+}
+
+const listenersYAML = `
+listeners:
+  - name: internal
+    address: "10.0.0.1:80"
+    network: tcp4
+  - name: public-v6
+    address: "[2001:db8::1]:80"
+    network: tcp6
+  - name: public-tls
+    address: ":443"
+    scheme: https
+    tls_profile: public
+    routes: [entropy]
+tls_profiles:
+  public:
+    cert: %s
+    key: %s
+source:
+  device: /dev/urandom
+`
+
+// TestListenerSpecs checks parsing and validation of explicit listeners.
+func TestListenerSpecs(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, nil, 0644)
+	os.WriteFile(keyPath, nil, 0600)
+
+	valid := func() *Config {
+		cfg := defaultConfig()
+		if err := yaml.Unmarshal([]byte(fmt.Sprintf(listenersYAML, certPath, keyPath)), cfg); err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	cfg := valid()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	specs := cfg.listeners()
+	if len(specs) != 3 || specs[0].Scheme != "http" || specs[2].TLSProfile != "public" {
+		t.Errorf("wrong listeners: %+v", specs)
+	}
+	if p, _ := cfg.tlsProfile("public"); p.MinVersion != cfg.TLS.MinVersion {
+		t.Errorf("profile did not inherit the minimum version, got: %q", p.MinVersion)
+	}
+
+	for name, mutate := range map[string]func(*Config){
+		"duplicate name":  func(c *Config) { c.Listeners[1].Name = "internal" },
+		"missing name":    func(c *Config) { c.Listeners[0].Name = "" },
+		"same port":       func(c *Config) { c.Listeners[1].Address = "10.0.0.1:80" },
+		"wildcard clash":  func(c *Config) { c.Listeners[1].Network, c.Listeners[1].Address = "tcp", "[::]:80" },
+		"family clash":    func(c *Config) { c.Listeners[1].Network, c.Listeners[1].Address = "tcp4", ":80" },
+		"metrics clash":   func(c *Config) { c.Metrics.Enabled, c.Metrics.Port = true, 443 },
+		"unknown network": func(c *Config) { c.Listeners[0].Network = "udp" },
+		"unknown scheme":  func(c *Config) { c.Listeners[0].Scheme = "gopher" },
+		"unknown profile": func(c *Config) { c.Listeners[2].TLSProfile = "private" },
+		"unknown route":   func(c *Config) { c.Listeners[2].Routes = []string{"admin"} },
+		"bad address":     func(c *Config) { c.Listeners[0].Address = "10.0.0.1" },
+	} {
+		cfg := valid()
+		mutate(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+	for name, mutate := range map[string]func(*Config){
+		"separate families": func(c *Config) { c.Listeners[0].Address, c.Listeners[1].Address = "0.0.0.0:80", "[::]:80" },
+		"other family":      func(c *Config) { c.Listeners[1].Address = "[::]:80" },
+	} {
+		cfg := valid()
+		mutate(cfg)
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		}
+	}
+}
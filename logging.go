@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+type LogConfig struct {
+	// Backend is text or json on stderr, syslog, journald, or remote for a
+	// syslog collector over the network
+	Backend string `yaml:"backend"`
+	// Level is the least severe level logged: debug, info, warn or error
+	Level  string             `yaml:"level"`
+	Remote RemoteSyslogConfig `yaml:"remote"`
+	// Queue is the number of messages waiting for the backend, beyond which
+	// they are dropped, or 0 to log synchronously
+	Queue int `yaml:"queue"`
+	// Sample maps event classes to N, logging only 1 in N of them
+	Sample map[string]int `yaml:"sample"`
+}
+
+// Levels above slog.LevelError for the messages logged just before pollen
+// exits, matching the syslog severities they used to be sent with.
+const (
+	LevelCritical  = slog.Level(12)
+	LevelEmergency = slog.Level(16)
+)
+
+var logBackends = map[string]bool{"text": true, "json": true, "syslog": true, "journald": true, "remote": true}
+
+// journalSocket is where journald receives native protocol messages, a
+// variable so that tests can stand in for journald.
+var journalSocket = "/run/systemd/journal/socket"
+
+// validate checks the backend and level names.
+func (c LogConfig) validate() error {
+	if !logBackends[c.Backend] {
+		return fmt.Errorf("unknown log backend %q", c.Backend)
+	}
+	var level slog.LevelVar
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("unknown log level %q", c.Level)
+	}
+	if c.Queue < 0 {
+		return fmt.Errorf("invalid log queue size: %d", c.Queue)
+	}
+	if err := validateSampling(c.Sample); err != nil {
+		return err
+	}
+	if c.Backend == "remote" {
+		return c.Remote.validate()
+	}
+	return nil
+}
+
+// replaceLevel names the levels above error for the text and JSON backends.
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.LevelKey || len(groups) > 0 {
+		return a
+	}
+	switch level := a.Value.Any().(slog.Level); {
+	case level >= LevelEmergency:
+		a.Value = slog.StringValue("EMERGENCY")
+	case level >= LevelCritical:
+		a.Value = slog.StringValue("CRITICAL")
+	}
+	return a
+}
+
+// newLogHandler creates the handler for the configured backend, logging at
+// level or above. Only syslog, journald and remote can fail, when there is no
+// daemon to talk to or the collector's CA can't be loaded.
+func newLogHandler(cfg LogConfig, level slog.Leveler, stderr io.Writer) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+	switch cfg.Backend {
+	case "json":
+		return slog.NewJSONHandler(stderr, opts), nil
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_ERR|syslog.LOG_DAEMON, "pollen")
+		if err != nil {
+			return nil, err
+		}
+		return newSyslogHandler(level, func(level slog.Level, msg string) error {
+			return localSyslog(w, level, msg)
+		}), nil
+	case "journald":
+		return newJournalHandler(level)
+	case "remote":
+		r, err := newRemoteSyslog(cfg.Remote)
+		if err != nil {
+			return nil, err
+		}
+		return newSyslogHandler(level, r.send), nil
+	}
+	return slog.NewTextHandler(stderr, opts), nil
+}
+
+// newLogger creates the logger for cfg at the level held by level, with
+// its queue if logging is asynchronous. If the backend can't be reached
+// pollen logs as text to stderr instead, rather than refusing to start, and
+// says so.
+func newLogger(cfg LogConfig, level *slog.LevelVar) (*slog.Logger, *logQueue) {
+	level.UnmarshalText([]byte(cfg.Level))
+	h, err := newLogHandler(cfg, level, os.Stderr)
+	if err != nil {
+		h, _ = newLogHandler(LogConfig{Backend: "text"}, level, os.Stderr)
+	}
+	var queue *logQueue
+	if cfg.Queue > 0 {
+		queue = newLogQueue(cfg.Queue)
+		h = &asyncHandler{h, queue}
+	}
+	if len(cfg.Sample) > 0 {
+		h = newSampleHandler(h, cfg.Sample)
+	}
+	log := slog.New(h)
+	if err != nil {
+		log.Warn("Cannot log to the configured backend, logging to stderr instead", "backend", cfg.Backend, "error", err)
+	}
+	return log, queue
+}
+
+// syslogHandler formats records as text without a time or level, which
+// syslog has fields for, and hands them to send.
+type syslogHandler struct {
+	slog.Handler
+	send func(level slog.Level, msg string) error
+	// the text handler writes into buf, guarded by mu, shared by all the
+	// handlers derived with WithAttrs and WithGroup
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func newSyslogHandler(level slog.Leveler, send func(level slog.Level, msg string) error) slog.Handler {
+	buf := &bytes.Buffer{}
+	text := slog.NewTextHandler(buf, &slog.HandlerOptions{Level: level, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+			return slog.Attr{}
+		}
+		return a
+	}})
+	return &syslogHandler{text, send, &sync.Mutex{}, buf}
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.send(r.Level, strings.TrimSuffix(h.buf.String(), "\n"))
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{h.Handler.WithAttrs(attrs), h.send, h.mu, h.buf}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{h.Handler.WithGroup(name), h.send, h.mu, h.buf}
+}
+
+// localSyslog sends a message to the local syslog daemon with the severity
+// matching its level.
+func localSyslog(w *syslog.Writer, level slog.Level, msg string) error {
+	switch {
+	case level >= LevelEmergency:
+		return w.Emerg(msg)
+	case level >= LevelCritical:
+		return w.Crit(msg)
+	case level >= slog.LevelError:
+		return w.Err(msg)
+	case level >= slog.LevelWarn:
+		return w.Warning(msg)
+	case level >= slog.LevelInfo:
+		return w.Info(msg)
+	}
+	return w.Debug(msg)
+}
+
+// journalHandler sends records to journald over its native protocol, each
+// attribute becoming a field so that journalctl can filter on them, e.g.
+// journalctl CLIENT=192.0.2.1.
+type journalHandler struct {
+	conn  *net.UnixConn
+	level slog.Leveler
+	// attrs are the fields added with WithAttrs, already prefixed with the
+	// groups they were added in
+	attrs  []journalField
+	prefix string
+}
+
+type journalField struct {
+	key, value string
+}
+
+func newJournalHandler(level slog.Leveler) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+// syslogSeverity maps levels to syslog severities.
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= LevelEmergency:
+		return 0
+	case level >= LevelCritical:
+		return 2
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// journalKey makes an attribute key a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore.
+func journalKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(key, "_")
+}
+
+// journalFields flattens an attribute, and any group it is, into fields.
+func journalFields(prefix string, a slog.Attr) []journalField {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return nil
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		var fields []journalField
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range a.Value.Group() {
+			fields = append(fields, journalFields(prefix, ga)...)
+		}
+		return fields
+	}
+	return []journalField{{journalKey(prefix + a.Key), a.Value.String()}}
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := []journalField{
+		{"MESSAGE", r.Message},
+		{"PRIORITY", fmt.Sprint(syslogSeverity(r.Level))},
+		{"SYSLOG_IDENTIFIER", "pollen"},
+	}
+	fields = append(fields, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = append(fields, journalFields(h.prefix, a)...)
+		return true
+	})
+	var b bytes.Buffer
+	for _, f := range fields {
+		if f.key == "" {
+			continue
+		}
+		if !strings.Contains(f.value, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", f.key, f.value)
+			continue
+		}
+		// values with newlines are sent with their length instead
+		b.WriteString(f.key + "\n")
+		binary.Write(&b, binary.LittleEndian, uint64(len(f.value)))
+		b.WriteString(f.value + "\n")
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]journalField{}, h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, journalFields(h.prefix, a)...)
+	}
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "_"
+	return &h2
+}
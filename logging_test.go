@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLogConfigValidate checks the backend and level names.
+func TestLogConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg LogConfig
+		ok  bool
+	}{
+		{LogConfig{Backend: "syslog", Level: "info"}, true},
+		{LogConfig{Backend: "json", Level: "DEBUG"}, true},
+		{LogConfig{Backend: "journald", Level: "warn"}, true},
+		{LogConfig{Backend: "text", Level: "error"}, true},
+		{LogConfig{Backend: "stdout", Level: "info"}, false},
+		{LogConfig{Backend: "text", Level: "verbose"}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%v: unexpected result: %v", tc.cfg, err)
+		}
+	}
+}
+
+// TestJSONLogLevel checks records below the level are dropped, that the
+// level can be changed while running, and that the levels above error are
+// named.
+func TestJSONLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	level.Set(slog.LevelWarn)
+	h, err := newLogHandler(LogConfig{Backend: "json"}, &level, &buf)
+	if err != nil {
+		t.Fatalf("newLogHandler failed: %s", err)
+	}
+	log := slog.New(h)
+	log.Info("dropped")
+	log.Log(context.Background(), LevelCritical, "kept", "client", "192.0.2.1")
+	level.Set(slog.LevelDebug)
+	log.Debug("now kept")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got: %q", lines)
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	if rec["level"] != "CRITICAL" || rec["msg"] != "kept" || rec["client"] != "192.0.2.1" {
+		t.Errorf("unexpected record: %v", rec)
+	}
+}
+
+// TestJournalHandler stands in for journald and checks the fields sent.
+func TestJournalHandler(t *testing.T) {
+	defer func(path string) { journalSocket = path }(journalSocket)
+	journalSocket = filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer conn.Close()
+
+	h, err := newLogHandler(LogConfig{Backend: "journald"}, slog.LevelInfo, nil)
+	if err != nil {
+		t.Fatalf("newLogHandler failed: %s", err)
+	}
+	slog.New(h).With("request_id", "abc").WithGroup("tls").Error("Handshake failed", "peer-name", "multi\nline")
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("cannot read: %s", err)
+	}
+	msg := string(buf[:n])
+	for _, want := range []string{"MESSAGE=Handshake failed\n", "PRIORITY=3\n", "SYSLOG_IDENTIFIER=pollen\n", "REQUEST_ID=abc\n", "TLS_PEER_NAME\n\x0a\x00\x00\x00\x00\x00\x00\x00multi\nline\n"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("missing %q in %q", want, msg)
+		}
+	}
+
+	journalSocket = filepath.Join(t.TempDir(), "missing")
+	if _, err := newLogHandler(LogConfig{Backend: "journald"}, slog.LevelInfo, nil); err == nil {
+		t.Error("expected an error without journald")
+	}
+}
+
+// TestRequestLogFields checks the fields logged for every request.
+func TestRequestLogFields(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := http.Server{Handler: s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy"}})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/?challenge=xxx", nil)
+	req.Header.Set("User-Agent", "pollinate/4.33")
+	res, err := http.DefaultClient.Do(req)
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.logger.mu.Lock()
+	defer s.logger.mu.Unlock()
+	s.Assert(len(s.logger.logs) == 2, "expected 2 log messages, got: ", s.logger.logs)
+	sent := s.logger.logs[len(s.logger.logs)-1]
+	for _, k := range []string{"request_id", "listener", "client", "ua", "duration", "entropy_avail"} {
+		s.Assert(sent.attrs[k] != "", "missing field ", k, " in ", sent)
+	}
+	s.Assert(sent.attrs["ua"] == "pollinate/4.33", "wrong ua: ", sent.attrs["ua"])
+	s.Assert(sent.attrs["request_id"] == s.logger.logs[0].attrs["request_id"], "request IDs differ")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type MaintenanceConfig struct {
+	// Message is the body of the 503 sent instead of entropy
+	Message string `yaml:"message"`
+	// RetryAfter is sent to clients in the Retry-After header
+	RetryAfter time.Duration `yaml:"retry_after"`
+	// FlagFile puts pollen in maintenance for as long as it exists, checked
+	// every Interval
+	FlagFile string        `yaml:"flag_file"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+const (
+	defaultMaintenanceMessage = "Server under maintenance, please retry later"
+	defaultRetryAfter         = 30 * time.Second
+)
+
+// validate checks the maintenance settings.
+func (c MaintenanceConfig) validate() error {
+	if c.RetryAfter < time.Second {
+		return errors.New("maintenance retry_after must be at least 1s")
+	}
+	if c.FlagFile != "" && c.Interval <= 0 {
+		return errors.New("maintenance interval must be positive")
+	}
+	return nil
+}
+
+// Maintenance sources, each of which can put pollen in maintenance. Pollen
+// serves entropy again once none of them does.
+const (
+	maintenanceAdmin  = "admin"
+	maintenanceSignal = "signal"
+	maintenanceFile   = "file"
+)
+
+// maintenance is whether pollen refuses to serve entropy, and what it says
+// instead. The zero value is usable, with the default message.
+type maintenance struct {
+	message    string
+	retryAfter time.Duration
+
+	mu      sync.Mutex
+	sources []string
+}
+
+// set puts pollen in or out of maintenance on behalf of source, and reports
+// whether that changed anything.
+func (m *maintenance) set(source string, on bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.Index(m.sources, source)
+	switch {
+	case on && i < 0:
+		m.sources = append(m.sources, source)
+	case !on && i >= 0:
+		m.sources = slices.Delete(m.sources, i, i+1)
+	default:
+		return false
+	}
+	return true
+}
+
+// active returns the sources keeping pollen in maintenance, none if it
+// serves.
+func (m *maintenance) active() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.sources)
+}
+
+// response returns the message and the Retry-After header sent while in
+// maintenance.
+func (m *maintenance) response() (string, string) {
+	message, retryAfter := m.message, m.retryAfter
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	return message, strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+}
+
+// setMaintenance puts pollen in or out of maintenance on behalf of source,
+// logging and reporting the change.
+func (p *PollenServer) setMaintenance(source string, on bool) {
+	if !p.maintenance.set(source, on) {
+		return
+	}
+	if on {
+		p.log.Warn("Entering maintenance", "source", source, "sources", p.maintenance.active())
+	} else {
+		p.log.Info("Leaving maintenance", "source", source, "sources", p.maintenance.active())
+	}
+	p.updateReady()
+}
+
+// watchFlagFile keeps pollen in maintenance while path exists, checking
+// every interval. It returns straight away, watching in the background.
+func (p *PollenServer) watchFlagFile(path string, interval time.Duration) {
+	failing := false
+	check := func() {
+		_, err := os.Stat(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// pollen stays as it was rather than guess
+			if !failing {
+				p.log.Warn("Cannot check maintenance flag file", "path", path, "error", err)
+			}
+			failing = true
+			return
+		}
+		failing = false
+		p.setMaintenance(maintenanceFile, err == nil)
+	}
+	check()
+	go func() {
+		for range time.Tick(interval) {
+			check()
+		}
+	}()
+}
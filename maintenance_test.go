@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestMaintenanceSources checks pollen stays in maintenance until every
+// source that put it there lets it go.
+func TestMaintenanceSources(t *testing.T) {
+	var m maintenance
+	for _, tc := range []struct {
+		source  string
+		on      bool
+		changed bool
+		active  []string
+	}{
+		{maintenanceAdmin, true, true, []string{"admin"}},
+		{maintenanceAdmin, true, false, []string{"admin"}},
+		{maintenanceFile, true, true, []string{"admin", "file"}},
+		{maintenanceAdmin, false, true, []string{"file"}},
+		{maintenanceSignal, false, false, []string{"file"}},
+		{maintenanceFile, false, true, nil},
+	} {
+		if changed := m.set(tc.source, tc.on); changed != tc.changed {
+			t.Errorf("%s %v: changed %v", tc.source, tc.on, changed)
+		}
+		if active := m.active(); !slices.Equal(active, tc.active) {
+			t.Errorf("%s %v: active %v, expected %v", tc.source, tc.on, active, tc.active)
+		}
+	}
+}
+
+// TestMaintenanceConfig checks the maintenance settings are validated.
+func TestMaintenanceConfig(t *testing.T) {
+	for _, tc := range []struct {
+		cfg MaintenanceConfig
+		ok  bool
+	}{
+		{defaultConfig().Maintenance, true},
+		{MaintenanceConfig{RetryAfter: 500 * time.Millisecond}, false},
+		{MaintenanceConfig{RetryAfter: time.Minute, FlagFile: "/run/pollen/maintenance"}, false},
+		{MaintenanceConfig{RetryAfter: time.Minute, FlagFile: "/run/pollen/maintenance", Interval: time.Second}, true},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: unexpected result: %v", tc.cfg, err)
+		}
+	}
+}
+
+// TestMaintenanceResponses checks entropy is refused with the configured
+// message while the health checks report draining.
+func TestMaintenanceResponses(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.maintenance.message, s.pollen.maintenance.retryAfter = "RNG maintenance until 14:00 UTC", 90*time.Second
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy", "health", "ready"}}))
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("http client error: %s", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+	s.pollen.setMaintenance(maintenanceSignal, true)
+	res, body := get("/?challenge=xxx")
+	s.Assert(res.StatusCode == http.StatusServiceUnavailable && res.Header.Get("Retry-After") == "90", "wrong response:", res.Status, res.Header)
+	s.Assert(body == "RNG maintenance until 14:00 UTC\n", "wrong message:", body)
+	res, body = get("/healthz")
+	s.Assert(res.StatusCode == http.StatusOK && body == "draining\n", "wrong health:", res.Status, body)
+	res, _ = get("/readyz")
+	s.Assert(res.StatusCode == http.StatusServiceUnavailable, "ready in maintenance:", res.Status)
+
+	s.pollen.setMaintenance(maintenanceSignal, false)
+	res, _ = get("/?challenge=xxx")
+	s.Assert(res.StatusCode == http.StatusOK, "not serving after maintenance:", res.Status)
+	res, body = get("/healthz")
+	s.Assert(body == "ok\n", "wrong health:", body)
+}
+
+// TestFlagFile checks the flag file puts pollen in maintenance for as long
+// as it exists.
+func TestFlagFile(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	path := filepath.Join(t.TempDir(), "maintenance")
+	s.pollen.watchFlagFile(path, 10*time.Millisecond)
+	s.Assert(len(s.pollen.maintenance.active()) == 0, "in maintenance without the flag file")
+
+	waitFor := func(active bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for (len(s.pollen.maintenance.active()) > 0) != active {
+			if time.Now().After(deadline) {
+				t.Fatalf("maintenance not %v", active)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	os.WriteFile(path, nil, 0644)
+	waitFor(true)
+	os.Remove(path)
+	waitFor(false)
+}
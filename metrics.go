@@ -1,22 +1,129 @@
 package main
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"math"
 	"net/http"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"time"
 )
 
+// version is set when building with -ldflags "-X main.version=..."
+var version = "dev"
+
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Port is the dedicated metrics listener's, or 0 for none
+	Port int `yaml:"port"`
+	// Scheme and TLSProfile are the dedicated listener's, as for listeners
+	Scheme     string `yaml:"scheme"`
+	TLSProfile string `yaml:"tls_profile"`
+	// Path is where the metrics are served
+	Path string            `yaml:"path"`
+	Auth MetricsAuthConfig `yaml:"auth"`
+	// Mount names listeners that also serve the metrics on Path
+	Mount []string `yaml:"mount"`
+	// Allow lists access_lists names or CIDRs of the clients the metrics are
+	// served to, everywhere they are served
+	Allow []string `yaml:"allow"`
+	// GoCollector and ProcessCollector add the Go runtime's and the
+	// process's metrics
+	GoCollector      bool             `yaml:"go_collector"`
+	ProcessCollector bool             `yaml:"process_collector"`
+	Histograms       HistogramsConfig `yaml:"histograms"`
+	// Push sends the metrics to servers that can't scrape pollen
+	Push PushConfig `yaml:"push"`
+}
+
+type HistogramsConfig struct {
+	// Buckets maps histogram names to the upper bounds of their buckets,
+	// replacing the defaults
+	Buckets map[string][]float64 `yaml:"buckets"`
+	// Native also exports the histograms as Prometheus native histograms,
+	// with buckets growing by NativeBucketFactor
+	Native             bool    `yaml:"native"`
+	NativeBucketFactor float64 `yaml:"native_bucket_factor"`
+	// Exemplars attaches the request ID to latency observations
+	Exemplars bool `yaml:"exemplars"`
+}
+
+// histogramBuckets are the histograms and their default buckets.
+var histogramBuckets = map[string][]float64{
+	"pollen_http_response_seconds":                      {0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.1, 1.0},
+	"pollen_response_entropy_per_byte":                  {1.0, 2.0, 3.0, 4.0, 4.5, 5.0, 5.5, 6.0, 6.5, 7.0, 7.5},
+	"pollen_response_entropy_arithmetic_mean_deviation": {10.0, 20.0, 30.0, 40.0, 50.0, 60.0, 70.0, 80.0, 90.0, 100.0},
+	"pollen_device_seconds":                             {0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.01, 0.1, 1.0},
+}
+
+const (
+	nativeMaxBuckets     = 160
+	nativeMinResetPeriod = time.Hour
+	maxExemplarRequestID = 128 - len("request_id")
+)
+
+// validate checks the buckets are for known histograms and increase.
+func (c HistogramsConfig) validate() error {
+	for name, buckets := range c.Buckets {
+		if _, ok := histogramBuckets[name]; !ok {
+			return fmt.Errorf("unknown histogram %q", name)
+		}
+		if len(buckets) == 0 {
+			return fmt.Errorf("histogram %s has no buckets", name)
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return fmt.Errorf("histogram %s buckets must increase", name)
+			}
+		}
+	}
+	if c.Native && c.NativeBucketFactor <= 1 {
+		return fmt.Errorf("native_bucket_factor must be greater than 1")
+	}
+	return nil
+}
+
+// histogramOpts returns the options for the named histogram.
+func (c HistogramsConfig) histogramOpts(name, help string) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{Name: name, Help: help, Buckets: histogramBuckets[name]}
+	if buckets, ok := c.Buckets[name]; ok {
+		opts.Buckets = buckets
+	}
+	if c.Native {
+		opts.NativeHistogramBucketFactor = c.NativeBucketFactor
+		opts.NativeHistogramMaxBucketNumber = nativeMaxBuckets
+		opts.NativeHistogramMinResetDuration = nativeMinResetPeriod
+	}
+	return opts
+}
+
 type Tracker struct {
-	pollenHttpRequestTotal                       prometheus.Counter
+	registry                                     *prometheus.Registry
+	exemplars                                    bool
+	pollenHttpRequestTotal                       *prometheus.CounterVec
 	pollenHttpResponseCode                       *prometheus.CounterVec
 	pollenHttpResponseSeconds                    *prometheus.HistogramVec
 	pollenSystemEntropy                          prometheus.Gauge
+	pollenSystemEntropyPoolSize                  prometheus.Gauge
+	pollenSystemEntropyWriteWakeupThreshold      prometheus.Gauge
+	pollenSystemCRNGReady                        prometheus.Gauge
 	pollenResponseEntropyPerByte                 prometheus.Histogram
 	pollenResponseEntropyArithmeticMeanDeviation prometheus.Histogram
+	pollenHttpThrottledTotal                     *prometheus.CounterVec
+	pollenHttpRequestsInFlight                   prometheus.Gauge
+	pollenHttpRequestsQueued                     prometheus.Gauge
+	pollenHttpShedTotal                          *prometheus.CounterVec
+	pollenHttpDeniedTotal                        *prometheus.CounterVec
+	pollenHttpResponseBytesTotal                 *prometheus.CounterVec
+	pollenDeviceSeconds                          *prometheus.HistogramVec
+	pollenDeviceErrorsTotal                      *prometheus.CounterVec
+	pollenChallengeWriteFailuresTotal            *prometheus.CounterVec
+	pollenReady                                  prometheus.Gauge
+	pollenCRNGWaitSeconds                        prometheus.Gauge
 }
 
 // entropyPerByte calculates the entropy per byte for a given byte array.
@@ -65,39 +172,173 @@ func (t *Tracker) chiSquare(input []byte) float64 {
 }
 
 // RequestReceived increments the counter for the total number of HTTP requests
-// received by the application. If the Tracker receiver is nil, the function
+// received on the named listener. If the Tracker receiver is nil, the function
 // does nothing.
-func (t *Tracker) RequestReceived() {
+func (t *Tracker) RequestReceived(listener string) {
 	if t == nil {
 		return
 	}
-	t.pollenHttpRequestTotal.Inc()
+	t.pollenHttpRequestTotal.WithLabelValues(listener).Inc()
 }
 
 // ResponseSent increments the counters for HTTP response codes and observes
-// the duration in the histogram vector for HTTP response times. If the
-// Tracker receiver is nil, the function does nothing.
-func (t *Tracker) ResponseSent(code int, duration time.Duration) {
+// the duration in the histogram vector for HTTP response times, both labelled
+// with the listener the request arrived on. If the Tracker receiver is nil,
+// the function does nothing.
+func (t *Tracker) ResponseSent(listener, requestID string, code int, duration time.Duration) {
 	if t == nil {
 		return
 	}
 	sc := strconv.Itoa(code)
-	t.pollenHttpResponseCode.WithLabelValues(sc).Inc()
-	t.pollenHttpResponseSeconds.WithLabelValues(sc).Observe(duration.Seconds())
+	t.pollenHttpResponseCode.WithLabelValues(listener, sc).Inc()
+	t.observe(t.pollenHttpResponseSeconds.WithLabelValues(listener, sc), duration.Seconds(), requestID)
+}
+
+// observe records v, with the request ID as its exemplar if they are
+// enabled.
+func (t *Tracker) observe(o prometheus.Observer, v float64, requestID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && t.exemplars && requestID != "" {
+		if len(requestID) > maxExemplarRequestID {
+			requestID = requestID[:maxExemplarRequestID]
+		}
+		eo.ObserveWithExemplar(v, prometheus.Labels{"request_id": requestID})
+		return
+	}
+	o.Observe(v)
+}
+
+// PoolStats sets the gauges for the kernel's random pool, leaving those
+// whose values are unknown. If the Tracker receiver is nil, the function
+// does nothing.
+func (t *Tracker) PoolStats(stats poolStats) {
+	if t == nil {
+		return
+	}
+	for _, g := range []struct {
+		gauge prometheus.Gauge
+		value int
+	}{
+		{t.pollenSystemEntropy, stats.EntropyAvail},
+		{t.pollenSystemEntropyPoolSize, stats.PoolSize},
+		{t.pollenSystemEntropyWriteWakeupThreshold, stats.WriteWakeupThreshold},
+	} {
+		if g.value >= 0 {
+			g.gauge.Set(float64(g.value))
+		}
+	}
+	ready := 0.0
+	if stats.CRNGReady {
+		ready = 1
+	}
+	t.pollenSystemCRNGReady.Set(ready)
+}
+
+// Throttled increments the counter for requests on the named listener that
+// were refused by the rate limiter. If the Tracker receiver is nil, the
+// function does nothing.
+func (t *Tracker) Throttled(listener string) {
+	if t == nil {
+		return
+	}
+	t.pollenHttpThrottledTotal.WithLabelValues(listener).Inc()
+}
+
+// Concurrency sets the gauges for the number of requests being served and
+// waiting to be. If the Tracker receiver is nil, the function does nothing.
+func (t *Tracker) Concurrency(inFlight, queued int) {
+	if t == nil {
+		return
+	}
+	t.pollenHttpRequestsInFlight.Set(float64(inFlight))
+	t.pollenHttpRequestsQueued.Set(float64(queued))
+}
+
+// Shed increments the counter for requests on the named listener that were
+// refused because pollen was too busy. If the Tracker receiver is nil, the
+// function does nothing.
+func (t *Tracker) Shed(listener string) {
+	if t == nil {
+		return
+	}
+	t.pollenHttpShedTotal.WithLabelValues(listener).Inc()
+}
+
+// Denied increments the counter for requests on the named listener that were
+// refused by an access list. If the Tracker receiver is nil, the function
+// does nothing.
+func (t *Tracker) Denied(listener, list string) {
+	if t == nil {
+		return
+	}
+	t.pollenHttpDeniedTotal.WithLabelValues(listener, list).Inc()
+}
+
+// Ready sets the gauge for whether pollen serves entropy yet. If the Tracker
+// receiver is nil, the function does nothing.
+func (t *Tracker) Ready(ready bool) {
+	if t == nil {
+		return
+	}
+	v := 0.0
+	if ready {
+		v = 1
+	}
+	t.pollenReady.Set(v)
+}
+
+// CRNGWaited sets the gauge for how long pollen waited at startup for the
+// kernel's CRNG. If the Tracker receiver is nil, the function does nothing.
+func (t *Tracker) CRNGWaited(waited time.Duration) {
+	if t == nil {
+		return
+	}
+	t.pollenCRNGWaitSeconds.Set(waited.Seconds())
+}
+
+// BytesServed adds the size of a response body to the counter of bytes sent
+// on the named listener. If the Tracker receiver is nil, the function does
+// nothing.
+func (t *Tracker) BytesServed(listener string, n int) {
+	if t == nil {
+		return
+	}
+	t.pollenHttpResponseBytesTotal.WithLabelValues(listener).Add(float64(n))
 }
 
-// SystemEntropy sets the gauge for system entropy. The input should be the
-// content of /proc/sys/kernel/random/entropy_avail. If the Tracker receiver
-// is nil or the input is not valid, the function does nothing.
-func (t *Tracker) SystemEntropy(entropyAvail []byte) {
+// DeviceAccess observes how long a read or write of the random device took,
+// and counts it as an error if it failed. If the Tracker receiver is nil,
+// the function does nothing.
+func (t *Tracker) DeviceAccess(op, requestID string, duration time.Duration, err error) {
 	if t == nil {
 		return
 	}
-	ent, err := strconv.ParseFloat(string(entropyAvail), 64)
-	if err == nil {
+	t.observe(t.pollenDeviceSeconds.WithLabelValues(op), duration.Seconds(), requestID)
+	if err != nil {
+		t.pollenDeviceErrorsTotal.WithLabelValues(op).Inc()
+	}
+}
+
+// ChallengeWriteFailed increments the counter for challenges from the named
+// listener that could not be mixed into the random device. If the Tracker
+// receiver is nil, the function does nothing.
+func (t *Tracker) ChallengeWriteFailed(listener string) {
+	if t == nil {
 		return
 	}
-	t.pollenSystemEntropy.Set(ent)
+	t.pollenChallengeWriteFailuresTotal.WithLabelValues(listener).Inc()
+}
+
+// CountLogDrops exports the number of log messages dropped because the
+// logging queue was full, as counted by dropped. If the Tracker receiver is
+// nil, the function does nothing.
+func (t *Tracker) CountLogDrops(dropped func() int64) {
+	if t == nil {
+		return
+	}
+	promauto.With(t.registry).NewCounterFunc(prometheus.CounterOpts{
+		Name: "pollen_log_dropped_total",
+		Help: "Log messages dropped because the logging queue was full",
+	}, func() float64 { return float64(dropped()) })
 }
 
 // EntropyQa observes the arithmetic mean deviation and entropy per byte of the
@@ -111,42 +352,124 @@ func (t *Tracker) EntropyQa(input []byte) {
 	t.pollenResponseEntropyPerByte.Observe(t.entropyPerByte(input))
 }
 
-// StartMetricsServer starts a HTTP server that exposes the metrics in Prometheus format.
-func (t *Tracker) StartMetricsServer(address string) error {
-	metricMux := http.NewServeMux()
-	metricMux.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(address, metricMux)
+// Handler serves the metrics in its registry in Prometheus format.
+func (t *Tracker) Handler() http.Handler {
+	return promhttp.HandlerFor(t.registry, promhttp.HandlerOpts{
+		Registry: t.registry,
+		// exemplars are only exposed in the OpenMetrics format
+		EnableOpenMetrics: t.exemplars,
+	})
+}
+
+// buildInfo returns the labels describing this build of pollen.
+func buildInfo() prometheus.Labels {
+	labels := prometheus.Labels{"version": version, "goversion": runtime.Version(), "revision": "unknown"}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				labels["revision"] = s.Value
+			}
+		}
+	}
+	return labels
 }
 
-// NewTracker creates a new Tracker with the Prometheus metrics initialized.
-func NewTracker() *Tracker {
+// NewTracker creates a new Tracker with the Prometheus metrics initialized
+// and registered with reg, which nothing else need share, and histograms as
+// configured by cfg.
+func NewTracker(reg *prometheus.Registry, cfg HistogramsConfig) *Tracker {
+	factory := promauto.With(reg)
+	factory.NewGauge(prometheus.GaugeOpts{
+		Name:        "pollen_build_info",
+		Help:        "Always 1, labelled with the version pollen was built from",
+		ConstLabels: buildInfo(),
+	}).Set(1)
+	factory.NewGauge(prometheus.GaugeOpts{
+		Name: "pollen_start_time_seconds",
+		Help: "When pollen started, in seconds since the epoch",
+	}).SetToCurrentTime()
 	return &Tracker{
-		pollenHttpRequestTotal: promauto.NewCounter(prometheus.CounterOpts{
+		registry:  reg,
+		exemplars: cfg.Exemplars,
+		pollenHttpRequestTotal: factory.NewCounterVec(prometheus.CounterOpts{
 			Name: "pollen_http_requests_total",
-			Help: "The total number of requests",
-		}),
-		pollenHttpResponseCode: promauto.NewCounterVec(prometheus.CounterOpts{
+			Help: "The total number of requests by listener",
+		}, []string{"listener"}),
+		pollenHttpResponseCode: factory.NewCounterVec(prometheus.CounterOpts{
 			Name: "pollen_http_responses_codes",
-			Help: "Total responses sent to clients by code",
-		}, []string{"code"}),
-		pollenHttpResponseSeconds: promauto.NewHistogramVec(prometheus.HistogramOpts{
-			Name:    "pollen_http_response_seconds",
-			Help:    "Response time by code",
-			Buckets: []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.1, 1.0},
-		}, []string{"code"}),
-		pollenSystemEntropy: promauto.NewGauge(prometheus.GaugeOpts{
+			Help: "Total responses sent to clients by listener and code",
+		}, []string{"listener", "code"}),
+		pollenHttpResponseSeconds: factory.NewHistogramVec(cfg.histogramOpts(
+			"pollen_http_response_seconds",
+			"Response time by listener and code",
+		), []string{"listener", "code"}),
+		pollenSystemEntropy: factory.NewGauge(prometheus.GaugeOpts{
 			Name: "pollen_system_entropy",
 			Help: "System available entropy (entropy_avail)",
 		}),
-		pollenResponseEntropyPerByte: promauto.NewHistogram(prometheus.HistogramOpts{
-			Name:    "pollen_response_entropy_per_byte",
-			Help:    "Entropy per bit of the random data in response",
-			Buckets: []float64{1.0, 2.0, 3.0, 4.0, 4.5, 5.0, 5.5, 6.0, 6.5, 7.0, 7.5},
+		pollenSystemEntropyPoolSize: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_system_entropy_poolsize",
+			Help: "Size of the system entropy pool in bits (poolsize)",
+		}),
+		pollenSystemEntropyWriteWakeupThreshold: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_system_entropy_write_wakeup_threshold",
+			Help: "Entropy below which writers to the pool are woken (write_wakeup_threshold)",
+		}),
+		pollenSystemCRNGReady: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_system_crng_ready",
+			Help: "Whether the kernel CRNG has been seeded",
+		}),
+		pollenResponseEntropyPerByte: factory.NewHistogram(cfg.histogramOpts(
+			"pollen_response_entropy_per_byte",
+			"Entropy per bit of the random data in response",
+		)),
+		pollenResponseEntropyArithmeticMeanDeviation: factory.NewHistogram(cfg.histogramOpts(
+			"pollen_response_entropy_arithmetic_mean_deviation",
+			"Arithmetic mean deviation of the random data in response",
+		)),
+		pollenHttpThrottledTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pollen_http_throttled_total",
+			Help: "Requests refused by the per-client rate limit by listener",
+		}, []string{"listener"}),
+		pollenHttpRequestsInFlight: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_http_requests_in_flight",
+			Help: "Requests currently being served",
+		}),
+		pollenHttpRequestsQueued: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_http_requests_queued",
+			Help: "Requests waiting for the concurrency limit",
+		}),
+		pollenHttpShedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pollen_http_shed_total",
+			Help: "Requests refused by the concurrency limit by listener",
+		}, []string{"listener"}),
+		pollenHttpDeniedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pollen_http_denied_total",
+			Help: "Requests refused by an access list by listener and list",
+		}, []string{"listener", "list"}),
+		pollenHttpResponseBytesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pollen_http_response_bytes_total",
+			Help: "Bytes of response bodies sent by listener",
+		}, []string{"listener"}),
+		pollenDeviceSeconds: factory.NewHistogramVec(cfg.histogramOpts(
+			"pollen_device_seconds",
+			"Time taken to read or write the random device by operation",
+		), []string{"op"}),
+		pollenDeviceErrorsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pollen_device_errors_total",
+			Help: "Failed reads and writes of the random device by operation",
+		}, []string{"op"}),
+		pollenChallengeWriteFailuresTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "pollen_challenge_write_failures_total",
+			Help: "Challenges that could not be written to the random device by listener",
+		}, []string{"listener"}),
+		pollenReady: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_ready",
+			Help: "Whether entropy is being served, once the kernel CRNG is ready",
 		}),
-		pollenResponseEntropyArithmeticMeanDeviation: promauto.NewHistogram(prometheus.HistogramOpts{
-			Name:    "pollen_response_entropy_arithmetic_mean_deviation",
-			Help:    "Arithmetic mean deviation of the random data in response",
-			Buckets: []float64{10.0, 20.0, 30.0, 40.0, 50.0, 60.0, 70.0, 80.0, 90.0, 100.0},
+		pollenCRNGWaitSeconds: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "pollen_crng_wait_seconds",
+			Help: "Time spent waiting at startup for the kernel CRNG to be ready",
 		}),
 	}
 }
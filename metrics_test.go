@@ -2,8 +2,17 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type testData struct {
@@ -140,3 +149,160 @@ func TestTracker_EntropyQA(t *testing.T) {
 		}
 	}
 }
+
+// writeFailingDev reads from /dev/urandom but refuses challenges.
+type writeFailingDev struct {
+	io.Reader
+}
+
+func (writeFailingDev) Write([]byte) (int, error) {
+	return 0, errors.New("read-only device")
+}
+
+// gathered returns the value of a counter or gauge, or the count of a
+// histogram, summed over the labels that match.
+func gathered(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %s", err)
+	}
+	var sum float64
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				sum += m.Counter.GetValue()
+			case m.Gauge != nil:
+				sum += m.Gauge.GetValue()
+			case m.Histogram != nil:
+				sum += float64(m.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return sum
+}
+
+// TestTrackerRegistry checks that trackers with registries of their own
+// don't clash, and that serving a request is counted.
+func TestTrackerRegistry(t *testing.T) {
+	other := NewTracker(prometheus.NewRegistry(), HistogramsConfig{})
+	other.RequestReceived("http")
+
+	urandom, err := os.Open("/dev/urandom")
+	if err != nil {
+		t.Fatalf("Cannot open device: %s", err)
+	}
+	s := NewSuiteWithDev(t, writeFailingDev{urandom})
+	defer s.TearDown()
+	defer urandom.Close()
+	reg := prometheus.NewRegistry()
+	s.pollen.tracker = NewTracker(reg, HistogramsConfig{})
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "https", Routes: []string{"entropy"}}))
+	defer server.Close()
+	res, err := http.Get(server.URL + "?challenge=xxx")
+	if err != nil {
+		t.Fatalf("http client error: %s", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	for _, tc := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"pollen_http_requests_total", map[string]string{"listener": "https"}, 1},
+		{"pollen_http_response_bytes_total", map[string]string{"listener": "https"}, float64(len(body))},
+		{"pollen_device_seconds", map[string]string{"op": "read"}, 1},
+		{"pollen_device_errors_total", map[string]string{"op": "write"}, 1},
+		{"pollen_device_errors_total", map[string]string{"op": "read"}, 0},
+		{"pollen_challenge_write_failures_total", map[string]string{"listener": "https"}, 1},
+		{"pollen_build_info", map[string]string{"version": version}, 1},
+	} {
+		if got := gathered(t, reg, tc.name, tc.labels); got != tc.want {
+			t.Errorf("%s%v: expected %v, got %v", tc.name, tc.labels, tc.want, got)
+		}
+	}
+	if start := gathered(t, reg, "pollen_start_time_seconds", nil); start < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("wrong start time: %v", start)
+	}
+
+	metricsServer := httptest.NewServer(s.pollen.tracker.Handler())
+	defer metricsServer.Close()
+	res, err = http.Get(metricsServer.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("http client error: %s", err)
+	}
+	metrics, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(metrics), `pollen_http_requests_total{listener="https"} 1`) {
+		t.Errorf("metrics not served:\n%s", metrics)
+	}
+}
+
+// TestHistogramsConfig checks custom buckets, native histograms and
+// exemplars.
+func TestHistogramsConfig(t *testing.T) {
+	for _, tc := range []struct {
+		cfg HistogramsConfig
+		ok  bool
+	}{
+		{HistogramsConfig{Buckets: map[string][]float64{"pollen_http_response_seconds": {0.01, 0.02, 0.05}}}, true},
+		{HistogramsConfig{Buckets: map[string][]float64{"pollen_http_requests_total": {1}}}, false},
+		{HistogramsConfig{Buckets: map[string][]float64{"pollen_device_seconds": {}}}, false},
+		{HistogramsConfig{Buckets: map[string][]float64{"pollen_device_seconds": {0.1, 0.1}}}, false},
+		{HistogramsConfig{Native: true, NativeBucketFactor: 1.1}, true},
+		{HistogramsConfig{Native: true, NativeBucketFactor: 1}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: unexpected result: %v", tc.cfg, err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	tracker := NewTracker(reg, HistogramsConfig{
+		Buckets:            map[string][]float64{"pollen_http_response_seconds": {0.01, 0.02, 0.05}},
+		Native:             true,
+		NativeBucketFactor: 1.1,
+		Exemplars:          true,
+	})
+	tracker.ResponseSent("https", "vm-1234", 200, 15*time.Millisecond)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %s", err)
+	}
+	for _, f := range families {
+		if f.GetName() != "pollen_http_response_seconds" {
+			continue
+		}
+		h := f.GetMetric()[0].GetHistogram()
+		var bounds []float64
+		var exemplar string
+		for _, b := range h.GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+			if e := b.GetExemplar(); e != nil {
+				exemplar = e.GetLabel()[0].GetValue()
+			}
+		}
+		if len(bounds) != 3 || bounds[1] != 0.02 {
+			t.Errorf("wrong buckets: %v", bounds)
+		}
+		if h.Schema == nil || len(h.GetPositiveSpan()) == 0 {
+			t.Error("no native histogram")
+		}
+		if exemplar != "vm-1234" {
+			t.Errorf("wrong exemplar: %q", exemplar)
+		}
+		return
+	}
+	t.Error("response time histogram not gathered")
+}
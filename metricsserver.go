@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+type MetricsAuthConfig struct {
+	// Username and the password in PasswordFile are accepted with basic
+	// authentication
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+	// TokenFile holds a token accepted as a bearer token
+	TokenFile string `yaml:"token_file"`
+}
+
+// metricsAuth holds the credentials scrapers must present, loaded at startup
+// while pollen can still read them.
+type metricsAuth struct {
+	username, password, token []byte
+}
+
+// readSecret reads a credential from a file, without the trailing newline
+// editors leave.
+func readSecret(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if secret == "" {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return []byte(secret), nil
+}
+
+// load reads the credentials, or returns nil if none are configured. The
+// configuration must have been validated.
+func (c MetricsAuthConfig) load() (*metricsAuth, error) {
+	if c.Username == "" && c.PasswordFile == "" && c.TokenFile == "" {
+		return nil, nil
+	}
+	a := &metricsAuth{}
+	if c.PasswordFile != "" {
+		password, err := readSecret(c.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		a.username, a.password = []byte(c.Username), password
+	}
+	if c.TokenFile != "" {
+		token, err := readSecret(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.token = token
+	}
+	return a, nil
+}
+
+// allowed reports whether r carries valid credentials. If the metricsAuth
+// receiver is nil every request is allowed.
+func (a *metricsAuth) allowed(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.token != nil {
+		return subtle.ConstantTimeCompare([]byte(token), a.token) == 1
+	}
+	if username, password, ok := r.BasicAuth(); ok && a.password != nil {
+		// both are compared, so that the time taken doesn't tell which was wrong
+		userOK := subtle.ConstantTimeCompare([]byte(username), a.username)
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), a.password)
+		return userOK&passwordOK == 1
+	}
+	return false
+}
+
+// challenge is the WWW-Authenticate header sent with a 401.
+func (a *metricsAuth) challenge() string {
+	if a.password != nil {
+		return `Basic realm="pollen metrics"`
+	}
+	return `Bearer realm="pollen metrics"`
+}
+
+// metricsListener is the name of the dedicated metrics listener, under
+// which metrics.allow is kept with the listeners' access control.
+const metricsListener = "metrics"
+
+// metricsSpec returns the dedicated metrics listener, if there is one.
+func (c *Config) metricsSpec() (ListenerSpec, bool) {
+	if !c.Metrics.Enabled || c.Metrics.Port == 0 {
+		return ListenerSpec{}, false
+	}
+	return ListenerSpec{
+		Name:       metricsListener,
+		Network:    "tcp",
+		Address:    fmt.Sprintf(":%d", c.Metrics.Port),
+		Scheme:     c.Metrics.Scheme,
+		TLSProfile: c.Metrics.TLSProfile,
+	}, true
+}
+
+// servedSpecs returns the listeners together with the dedicated metrics
+// and debug listeners and the admin socket, if there are any.
+func (c *Config) servedSpecs() []ListenerSpec {
+	specs := c.listeners()
+	if spec, ok := c.metricsSpec(); ok {
+		specs = append(specs, spec)
+	}
+	if spec, ok := c.debugSpec(); ok {
+		specs = append(specs, spec)
+	}
+	if spec, ok := c.adminSpec(); ok {
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// validateMetrics checks where the metrics are served and who may see them.
+func (c *Config) validateMetrics() error {
+	m := c.Metrics
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("metrics path %q must start with /", m.Path)
+	}
+	for _, p := range routePaths {
+		if len(m.Mount) > 0 && m.Path == p {
+			return fmt.Errorf("metrics path %s is taken by a route", m.Path)
+		}
+	}
+	names := make(map[string]bool)
+	for _, spec := range c.listeners() {
+		names[spec.Name] = true
+	}
+	for _, name := range m.Mount {
+		if !names[name] {
+			return fmt.Errorf("metrics mounted on unknown listener %q", name)
+		}
+	}
+	if len(m.Mount) > 0 && len(m.Allow) == 0 {
+		return errors.New("metrics.mount needs metrics.allow")
+	}
+	if m.Auth.Username != "" && m.Auth.PasswordFile == "" || m.Auth.Username == "" && m.Auth.PasswordFile != "" {
+		return errors.New("metrics basic authentication needs both username and password_file")
+	}
+	if m.Push.enabled() && !m.Enabled {
+		return errors.New("metrics.push needs metrics.enabled")
+	}
+	return m.Push.validate()
+}
+
+// metricsHandler serves the metrics to the clients metrics.allow lets in and
+// that present the credentials, if any are configured.
+func (p *PollenServer) metricsHandler() http.Handler {
+	h := p.tracker.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if list := p.acls.Load().check(metricsListener, clientIP(r)); list != "" {
+			p.denied(w, r, listenerName(r.Context()), list)
+			return
+		}
+		if !p.metricsAuth.allowed(r) {
+			w.Header().Set("WWW-Authenticate", p.metricsAuth.challenge())
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// mountsMetrics reports whether the named listener also serves the metrics.
+func (p *PollenServer) mountsMetrics(listener string) bool {
+	return p.tracker != nil && slices.Contains(p.metricsMounts, listener)
+}
+
+// metricsServerHandler returns the handler for the dedicated metrics
+// listener.
+func (p *PollenServer) metricsServerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(p.metricsPath, p.metricsHandler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerKey{}, metricsListener)
+		mux.ServeHTTP(w, withClientAddr(r.WithContext(ctx), p.trustedProxies))
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestValidateMetrics checks where the metrics may be served.
+func TestValidateMetrics(t *testing.T) {
+	for name, tc := range map[string]struct {
+		mutate func(*MetricsConfig)
+		ok     bool
+	}{
+		"defaults":             {func(m *MetricsConfig) {}, true},
+		"mounted":              {func(m *MetricsConfig) { m.Mount, m.Allow = []string{"http"}, []string{"10.0.0.0/8"} }, true},
+		"mounted unrestricted": {func(m *MetricsConfig) { m.Mount = []string{"http"} }, false},
+		"unknown listener":     {func(m *MetricsConfig) { m.Mount, m.Allow = []string{"admin"}, []string{"10.0.0.0/8"} }, false},
+		"mounted on a route":   {func(m *MetricsConfig) { m.Mount, m.Allow, m.Path = []string{"http"}, []string{"10.0.0.0/8"}, "/" }, false},
+		"relative path":        {func(m *MetricsConfig) { m.Path = "metrics" }, false},
+		"no password":          {func(m *MetricsConfig) { m.Auth.Username = "prometheus" }, false},
+		"push disabled":        {func(m *MetricsConfig) { m.Push.StatsD.Address = "localhost:8125" }, false},
+		"push":                 {func(m *MetricsConfig) { m.Enabled, m.Port, m.Push.StatsD.Address = true, 0, "localhost:8125" }, true},
+	} {
+		cfg := defaultConfig()
+		tc.mutate(&cfg.Metrics)
+		if err := cfg.validateMetrics(); (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected result: %v", name, err)
+		}
+	}
+}
+
+// TestMetricsEndpoint checks the metrics mounted on a listener are only
+// served to allowed clients with credentials, and the dedicated metrics
+// listener likewise.
+func TestMetricsEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "password"), []byte("s3cret\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "token"), []byte("t0ken"), 0600)
+	auth, err := MetricsAuthConfig{Username: "prometheus", PasswordFile: filepath.Join(dir, "password"), TokenFile: filepath.Join(dir, "token")}.load()
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.tracker = NewTracker(prometheus.NewRegistry(), HistogramsConfig{})
+	s.pollen.metricsPath, s.pollen.metricsMounts, s.pollen.metricsAuth = "/internal/metrics", []string{"public"}, auth
+	cfg := defaultConfig()
+	cfg.Metrics.Allow = []string{"127.0.0.0/8"}
+	acls, err := cfg.accessControl()
+	if err != nil {
+		t.Fatalf("accessControl failed: %s", err)
+	}
+	s.pollen.acls.Store(&acls)
+	public := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "public", Routes: []string{"entropy"}}))
+	defer public.Close()
+	other := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "other", Routes: []string{"entropy"}}))
+	defer other.Close()
+	dedicated := httptest.NewServer(s.pollen.metricsServerHandler())
+	defer dedicated.Close()
+
+	get := func(url string, set func(*http.Request)) (int, string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		set(req)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http client error: %s", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	none := func(*http.Request) {}
+	basic := func(r *http.Request) { r.SetBasicAuth("prometheus", "s3cret") }
+	for _, tc := range []struct {
+		url    string
+		set    func(*http.Request)
+		status int
+	}{
+		{public.URL + "/internal/metrics", none, http.StatusUnauthorized},
+		{public.URL + "/internal/metrics", func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }, http.StatusUnauthorized},
+		{public.URL + "/internal/metrics", basic, http.StatusOK},
+		{public.URL + "/internal/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK},
+		{public.URL + "/internal/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{other.URL + "/internal/metrics", basic, http.StatusBadRequest},
+		{dedicated.URL + "/internal/metrics", basic, http.StatusOK},
+		{dedicated.URL + "/metrics", basic, http.StatusNotFound},
+	} {
+		status, body := get(tc.url, tc.set)
+		if status != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.url, tc.status, status)
+		}
+		if status == http.StatusOK && !strings.Contains(body, "pollen_build_info") {
+			t.Errorf("%s: no metrics served:\n%s", tc.url, body)
+		}
+	}
+
+	cfg.Metrics.Allow = []string{"192.0.2.0/24"}
+	acls, _ = cfg.accessControl()
+	s.pollen.acls.Store(&acls)
+	if status, _ := get(public.URL+"/internal/metrics", basic); status != http.StatusForbidden {
+		t.Errorf("client outside metrics.allow got %d", status)
+	}
+}
@@ -21,21 +21,30 @@ pollen: Entropy-as-a-Server web server
 package main
 
 import (
+	"context"
 	"crypto/sha512"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log/syslog"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 var (
+	configPath  = flag.String("config", "", "The full path to a YAML configuration file")
 	httpPort    = flag.String("http-port", "80", "The HTTP port on which to listen")
 	httpsPort   = flag.String("https-port", "443", "The HTTPS port on which to listen")
 	metricsPort = flag.String("metrics-port", "", "The Prometheus metrics HTTP endpoint port")
@@ -43,143 +52,359 @@ var (
 	size        = flag.Int("bytes", 64, "The size in bytes to read from the random device")
 	cert        = flag.String("cert", "/etc/pollen/cert.pem", "The full path to cert.pem")
 	key         = flag.String("key", "/etc/pollen/key.pem", "The full path to key.pem")
+	autogen     = flag.Bool("https-autogen", false, "Generate a self-signed cert.pem and key.pem if they are missing")
+	runAsUser   = flag.String("user", "", "The user to switch to once the device is open and the listeners are bound")
+	runAsGroup  = flag.String("group", "", "The group to switch to, the user's primary group if empty")
+	sandbox     = flag.Bool("sandbox", true, "Confine pollen with Landlock and seccomp once it is serving")
+	logBackend  = flag.String("log-backend", "syslog", "Where to log: text or json on stderr, syslog or journald")
+	logLevel    = flag.String("log-level", "info", "The least severe level logged: debug, info, warn or error")
 )
 
-// this matches the syslog.Writer functions
-type logger interface {
-	Close() error
-	Info(string) error
-	Err(string) error
-	Crit(string) error
-	Emerg(string) error
-}
-
 type PollenServer struct {
 	// randomSource is usually /dev/random or /dev/urandom
 	randomSource io.ReadWriter
-	log          logger
-	readSize     int
-	tracker      *Tracker
+	log          *slog.Logger
+	// logLevel is the least severe level logged, changed by the admin API
+	logLevel *slog.LevelVar
+	// readSize is the number of bytes read from the device for each
+	// response, changed by the admin API
+	readSize    atomic.Int64
+	tracker     *Tracker
+	limiter     *RateLimiter
+	concurrency *ConcurrencyLimiter
+	// trustedProxies may give the client address in forwarding headers
+	trustedProxies []*net.IPNet
+	// acls is replaced as a whole when the access lists are reloaded
+	acls      atomic.Pointer[accessControl]
+	deniedLog logSampler
+	accessLog *AccessLog
+	tracer    *Tracer
+	entropy   *EntropySampler
+	// metricsPath is where the metrics are served, on the dedicated metrics
+	// listener and the listeners in metricsMounts
+	metricsPath   string
+	metricsMounts []string
+	metricsAuth   *metricsAuth
+	// starting is set until the kernel's CRNG is ready to seed responses
+	starting atomic.Bool
+	// maintenance stops serving entropy, when asked by the admin API, a
+	// signal or the flag file
+	maintenance maintenance
+	logQueue    *logQueue
+	// certs are the listeners' certificates, reloaded by the admin API
+	certs []*certificate
 }
 
 const usePollinateError = "Please use the pollinate client.  'sudo apt-get install pollinate' or download from: https://bazaar.launchpad.net/~pollinate/pollinate/trunk/view/head:/pollinate"
 
 func (p *PollenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
-	p.tracker.RequestReceived()
-	var avail []byte
+	listener, id := listenerName(r.Context()), requestID(r.Context())
+	p.tracker.RequestReceived(listener)
+	if p.starting.Load() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Server starting, please retry later", http.StatusServiceUnavailable)
+		p.tracker.ResponseSent(listener, id, http.StatusServiceUnavailable, time.Since(startTime))
+		return
+	}
+	if len(p.maintenance.active()) > 0 {
+		message, retryAfter := p.maintenance.response()
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, message, http.StatusServiceUnavailable)
+		p.tracker.ResponseSent(listener, id, http.StatusServiceUnavailable, time.Since(startTime))
+		return
+	}
+	if ok, wait := p.limiter.Allow(clientIP(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests, please slow down", http.StatusTooManyRequests)
+		p.tracker.Throttled(listener)
+		p.tracker.ResponseSent(listener, id, http.StatusTooManyRequests, time.Since(startTime))
+		return
+	}
+	release, ok := p.concurrency.Acquire(r.Context())
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server busy, please retry later", http.StatusServiceUnavailable)
+		p.tracker.Shed(listener)
+		p.tracker.ResponseSent(listener, id, http.StatusServiceUnavailable, time.Since(startTime))
+		return
+	}
+	defer release()
+	log := p.log.With("request_id", id, "listener", listener, "client", clientAddr(r), "ua", r.UserAgent())
 	challenge := r.FormValue("challenge")
 	if challenge == "" {
 		http.Error(w, usePollinateError, http.StatusBadRequest)
-		p.tracker.ResponseSent(http.StatusBadRequest, time.Since(startTime))
+		p.tracker.ResponseSent(listener, id, http.StatusBadRequest, time.Since(startTime))
 		return
 	}
+	_, span := p.tracer.Start(r.Context(), "challenge.hash")
 	checksum := sha512.New()
 	io.WriteString(checksum, challenge)
 	challengeResponse := checksum.Sum(nil)
+	span.End()
 	var err error
+	_, span = p.tracer.Start(r.Context(), "device.write")
+	deviceStart := time.Now()
 	_, err = p.randomSource.Write(challengeResponse)
+	p.tracker.DeviceAccess("write", id, time.Since(deviceStart), err)
 	if err != nil {
-		/* Non-fatal error, but let's log this to syslog */
-		p.log.Err(fmt.Sprintf("Cannot write to random device at [%v]", time.Now().UnixNano()))
+		/* Non-fatal error, but let's log this */
+		log.Error("Cannot write to random device", "error", err)
+		p.tracker.ChallengeWriteFailed(listener)
+		span.Fail(err)
 	}
-	/* Record entropy bits before */
-	avail, err = ioutil.ReadFile("/proc/sys/kernel/random/entropy_avail")
-	if err != nil {
-		/* Non-fatal error */
-		p.log.Err(fmt.Sprintf("Cannot record entropy bits at [%v]", time.Now().UnixNano()))
-		avail = []byte{'?'}
-	}
-	p.log.Info(fmt.Sprintf("Server received challenge from [%s, %s] at [%v] with [e%s] available", r.RemoteAddr, r.UserAgent(), time.Now().UnixNano(), strings.Split(string(avail), "\n")[0]))
-	data := make([]byte, p.readSize)
+	span.End()
+	log.Info("Server received challenge", "event", "challenge", "entropy_avail", p.entropy.EntropyAvail())
+	data := make([]byte, p.readSize.Load())
+	_, span = p.tracer.Start(r.Context(), "device.read")
+	deviceStart = time.Now()
 	_, err = io.ReadFull(p.randomSource, data)
+	p.tracker.DeviceAccess("read", id, time.Since(deviceStart), err)
+	span.Fail(err)
+	span.End()
 	if err != nil {
 		/* Fatal error for this connection, if we can't read from device */
-		p.log.Err(fmt.Sprintf("Cannot read from random device at [%v]", time.Now().UnixNano()))
+		log.Error("Cannot read from random device", "error", err)
 		http.Error(w, "Failed to read from random device", http.StatusInternalServerError)
-		p.tracker.ResponseSent(http.StatusInternalServerError, time.Since(startTime))
+		p.tracker.ResponseSent(listener, id, http.StatusInternalServerError, time.Since(startTime))
 		return
 	}
 	p.tracker.EntropyQa(data)
 	checksum.Write(data)
 	/* The checksum of the bytes from /dev/random is simply for print-ability, when debugging */
 	seed := checksum.Sum(nil)
-	fmt.Fprintf(w, "%x\n%x\n", challengeResponse, seed)
-	p.tracker.ResponseSent(200, time.Since(startTime))
-	/* Record entropy bits after */
-	avail, err = ioutil.ReadFile("/proc/sys/kernel/random/entropy_avail")
-	if err != nil {
-		/* Non-fatal error */
-		p.log.Err(fmt.Sprintf("Cannot record entropy bits at [%v]", time.Now().UnixNano()))
-		avail = []byte{'?'}
-	} else {
-		p.tracker.SystemEntropy(avail)
-	}
-	p.log.Info(fmt.Sprintf("Server sent response to [%s, %s] at [%v] in [%.6fs] with [e%s] available",
-		r.RemoteAddr, r.UserAgent(), time.Now().UnixNano(), time.Since(startTime).Seconds(), strings.Split(string(avail), "\n")[0]))
+	_, span = p.tracer.Start(r.Context(), "response.write")
+	n, err := fmt.Fprintf(w, "%x\n%x\n", challengeResponse, seed)
+	p.tracker.BytesServed(listener, n)
+	span.Fail(err)
+	span.End()
+	p.tracker.ResponseSent(listener, id, 200, time.Since(startTime))
+	log.Info("Server sent response", "event", "response", "duration", time.Since(startTime), "entropy_avail", p.entropy.EntropyAvail())
 }
 
 func main() {
-	flag.Parse()
-	if *httpPort == "" && *httpsPort == "" {
-		fatal("Nothing to do if http and https are both disabled")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gencert":
+			gencertMain(os.Args[2:])
+			return
+		case "config":
+			configMain(os.Args[2:])
+			return
+		case "ctl":
+			ctlMain(os.Args[2:])
+			return
+		}
 	}
-	log, err := syslog.New(syslog.LOG_ERR, "pollen")
+	flag.Parse()
+	cfg, err := loadConfig()
 	if err != nil {
-		fatalf("Cannot open syslog: %s\n", err)
+		fatalf("Invalid configuration: %s\n", err)
 	}
-	defer log.Close()
-	log.Info(fmt.Sprintf("pollen starting at [%v]", time.Now().UnixNano()))
-	dev, err := os.OpenFile(*device, os.O_RDWR, 0)
+	level := new(slog.LevelVar)
+	log, logQueue := newLogger(cfg.Log, level)
+	log.Info("pollen starting")
+	dev, err := os.OpenFile(cfg.Source.Device, os.O_RDWR, 0)
 	if err != nil {
 		fatalf("Cannot open device: %s\n", err)
 	}
 	defer dev.Close()
+	for _, spec := range cfg.servedSpecs() {
+		profile, _ := cfg.tlsProfile(spec.TLSProfile)
+		if spec.Scheme != "https" || !profile.Autogen {
+			continue
+		}
+		pin, err := autogenCert(profile.Cert, profile.Key)
+		if err != nil {
+			fatalf("Cannot generate certificate: %s\n", err)
+		}
+		if pin != "" {
+			log.Info("Generated self-signed certificate", "cert", profile.Cert, "spki_pin", pin)
+			fmt.Printf("Generated self-signed certificate %s\nSPKI pin: %s\n", profile.Cert, pin)
+		}
+	}
 	var tracker *Tracker
 
-	if *metricsPort != "" {
-		tracker = NewTracker()
+	if cfg.Metrics.Enabled {
+		reg := prometheus.NewRegistry()
+		if cfg.Metrics.GoCollector {
+			reg.MustRegister(collectors.NewGoCollector())
+		}
+		if cfg.Metrics.ProcessCollector {
+			reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		}
+		tracker = NewTracker(reg, cfg.Metrics.Histograms)
+		tracker.CountLogDrops(logQueue.Dropped)
+		if err := tracker.StartPush(cfg.Metrics.Push, log); err != nil {
+			fatalf("Cannot push metrics: %s\n", err)
+		}
 	}
-	handler := &PollenServer{randomSource: dev, log: log, readSize: *size, tracker: tracker}
-	mux := http.NewServeMux()
-	mux.Handle("/", handler)
-	var httpListeners sync.WaitGroup
-	if *httpPort != "" {
-		httpAddr := fmt.Sprintf(":%s", *httpPort)
-		httpListeners.Add(1)
-		go func() {
-			handler.fatal(http.ListenAndServe(httpAddr, mux))
-			httpListeners.Done()
-		}()
+	limiter, err := NewRateLimiter(cfg.Limits.RateLimit)
+	if err != nil {
+		fatalf("Invalid rate limit: %s\n", err)
 	}
-	if *httpsPort != "" {
-		httpsAddr := fmt.Sprintf(":%s", *httpsPort)
-		httpListeners.Add(1)
-		go func() {
-			config := &tls.Config{MinVersion: tls.VersionTLS10}
-			server := &http.Server{Addr: httpsAddr, Handler: handler, TLSConfig: config}
-			handler.fatal(server.ListenAndServeTLS(*cert, *key))
-			httpListeners.Done()
-		}()
+	concurrency := NewConcurrencyLimiter(cfg.Limits.MaxInFlight, cfg.Limits.MaxQueued, cfg.Limits.QueueTimeout, tracker.Concurrency)
+	trusted, err := parseCIDRs(cfg.Proxy.Trusted)
+	if err != nil {
+		fatalf("Invalid trusted proxies: %s\n", err)
+	}
+	handler := &PollenServer{randomSource: dev, log: log, logLevel: level, tracker: tracker, limiter: limiter, concurrency: concurrency, trustedProxies: trusted}
+	handler.metricsPath, handler.metricsMounts = cfg.Metrics.Path, cfg.Metrics.Mount
+	handler.logQueue = logQueue
+	handler.readSize.Store(int64(cfg.Limits.ReadSize))
+	handler.maintenance.message, handler.maintenance.retryAfter = cfg.Maintenance.Message, cfg.Maintenance.RetryAfter
+	handler.metricsAuth, err = cfg.Metrics.Auth.load()
+	if err != nil {
+		fatalf("Cannot load metrics credentials: %s\n", err)
+	}
+	handler.accessLog, err = NewAccessLog(cfg.AccessLog)
+	if err != nil {
+		fatalf("Cannot open access log: %s\n", err)
+	}
+	handler.gateOnCRNG(cfg.Source.CRNGTimeout, crngReady)
+	handler.entropy = NewEntropySampler(cfg.Source.SampleInterval, tracker, log)
+	handler.tracer, err = NewTracer(cfg.Tracing, log)
+	if err != nil {
+		fatalf("Cannot trace requests: %s\n", err)
+	}
+	acls, err := cfg.accessControl()
+	if err != nil {
+		fatalf("Invalid access lists: %s\n", err)
+	}
+	handler.acls.Store(&acls)
+	/* Bind every listener before serving any of them, so that a bad address
+	   fails startup rather than leaving pollen half running */
+	var servers []func() error
+	for _, spec := range cfg.listeners() {
+		ln, err := openListener(spec)
+		if err != nil {
+			fatalf("Cannot listen on %s: %s\n", spec.Name, err)
+		}
+		if spec.ProxyProtocol {
+			ln = newProxyListener(ln, trusted)
+		}
+		server := cfg.Server.newServer(handler.listenerHandler(spec))
+		if spec.Scheme == "https" {
+			profile, _ := cfg.tlsProfile(spec.TLSProfile)
+			var cert *certificate
+			server.TLSConfig, cert, err = profile.serverConfig()
+			if err != nil {
+				fatalf("Cannot load certificate for %s: %s\n", spec.Name, err)
+			}
+			handler.certs = append(handler.certs, cert)
+			servers = append(servers, func() error { return server.ServeTLS(ln, "", "") })
+		} else {
+			servers = append(servers, func() error { return server.Serve(ln) })
+		}
+		log.Info("Listening", "address", ln.Addr().String(), "listener", spec.Name, "scheme", spec.Scheme)
+	}
+	if spec, ok := cfg.metricsSpec(); ok {
+		ln, err := openListener(spec)
+		if err != nil {
+			fatalf("Cannot listen on metrics: %s\n", err)
+		}
+		server := cfg.Server.newServer(handler.metricsServerHandler())
+		if spec.Scheme == "https" {
+			profile, _ := cfg.tlsProfile(spec.TLSProfile)
+			var cert *certificate
+			server.TLSConfig, cert, err = profile.serverConfig()
+			if err != nil {
+				fatalf("Cannot load certificate for metrics: %s\n", err)
+			}
+			handler.certs = append(handler.certs, cert)
+			servers = append(servers, func() error { return server.ServeTLS(ln, "", "") })
+		} else {
+			servers = append(servers, func() error { return server.Serve(ln) })
+		}
+	}
+	if spec, ok := cfg.debugSpec(); ok {
+		ln, err := openListener(spec)
+		if err != nil {
+			fatalf("Cannot listen on debug: %s\n", err)
+		}
+		server := cfg.Server.newServer(handler.debugHandler(cfg))
+		// profiles and traces take as long as they are asked to
+		server.WriteTimeout = 0
+		servers = append(servers, func() error { return server.Serve(ln) })
+		log.Warn("Debug endpoints enabled", "address", ln.Addr().String())
+	}
+	if spec, ok := cfg.adminSpec(); ok {
+		uids, err := cfg.adminUIDs()
+		if err != nil {
+			fatalf("Invalid admin users: %s\n", err)
+		}
+		ln, err := openListener(spec)
+		if err != nil {
+			fatalf("Cannot listen on admin socket: %s\n", err)
+		}
+		server := cfg.Server.newServer(handler.adminHandler(uids))
+		server.ConnContext = adminConnContext
+		servers = append(servers, func() error { return server.Serve(ln) })
+		log.Info("Admin API enabled", "socket", spec.Address)
 	}
-	if *metricsPort != "" {
-		metricsAddr := fmt.Sprintf(":%s", *metricsPort)
+	for _, socket := range closeUnclaimed() {
+		log.Warn("Closing a socket passed by systemd that no listener uses", "socket", socket)
+	}
+	if cfg.Privileges.User != "" {
+		if err := dropPrivileges(cfg.Privileges.User, cfg.Privileges.Group); err != nil {
+			handler.fatalf("Cannot drop privileges: %s\n", err)
+		}
+		log.Info("Dropped privileges", "user", cfg.Privileges.User, "group", cfg.Privileges.Group)
+	}
+	if cfg.Sandbox.Enabled {
+		applied, skipped, err := applySandbox(cfg)
+		if err != nil {
+			handler.fatalf("Cannot apply sandbox: %s\n", err)
+		}
+		for _, a := range applied {
+			log.Info("Sandbox applied", "sandbox", a)
+		}
+		for _, s := range skipped {
+			log.Warn("Sandbox not applied", "sandbox", s)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := handler.reloadACLs(); err != nil {
+				log.Error("Cannot reload access lists", "error", err)
+			} else {
+				log.Info("Reloaded access lists")
+			}
+			if err := handler.accessLog.Reopen(); err != nil {
+				log.Error("Cannot reopen access log", "error", err)
+			}
+		}
+	}()
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range usr {
+			handler.setMaintenance(maintenanceSignal, sig == syscall.SIGUSR1)
+		}
+	}()
+	if cfg.Maintenance.FlagFile != "" {
+		handler.watchFlagFile(cfg.Maintenance.FlagFile, cfg.Maintenance.Interval)
+	}
+	var httpListeners sync.WaitGroup
+	for _, serve := range servers {
 		httpListeners.Add(1)
-		go func() {
-			handler.fatal(tracker.StartMetricsServer(metricsAddr))
+		go func(serve func() error) {
+			handler.fatal(serve())
 			httpListeners.Done()
-		}()
+		}(serve)
 	}
 	httpListeners.Wait()
 }
 
 func (p *PollenServer) fatal(args ...interface{}) {
-	p.log.Crit(fmt.Sprint(args...))
+	p.log.Log(context.Background(), LevelCritical, fmt.Sprint(args...))
 	fatal(args...)
 }
 
 func (p *PollenServer) fatalf(format string, args ...interface{}) {
-	p.log.Emerg(fmt.Sprintf(format, args...))
+	p.log.Log(context.Background(), LevelEmergency, strings.TrimSpace(fmt.Sprintf(format, args...)))
 	fatalf(format, args...)
 }
 
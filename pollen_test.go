@@ -3,49 +3,72 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sync"
 	"testing"
 )
 
 type logEntry struct {
 	severity string
 	message  string
+	attrs    map[string]string
 }
 
+// localLogger keeps every record logged through its handler.
 type localLogger struct {
+	mu   sync.Mutex
 	logs []logEntry
 }
 
-func (l *localLogger) Close() error {
-	l.logs = append(l.logs, logEntry{"close", ""})
-	return nil
+// localHandler is the slog.Handler recording into a localLogger.
+type localHandler struct {
+	l     *localLogger
+	attrs []slog.Attr
 }
 
-func (l *localLogger) Info(msg string) error {
-	l.logs = append(l.logs, logEntry{"info", msg})
-	return nil
+func (h *localHandler) Enabled(context.Context, slog.Level) bool {
+	return true
 }
 
-func (l *localLogger) Err(msg string) error {
-	l.logs = append(l.logs, logEntry{"err", msg})
+func (h *localHandler) Handle(_ context.Context, r slog.Record) error {
+	severity := "info"
+	switch {
+	case r.Level >= LevelEmergency:
+		severity = "emerg"
+	case r.Level >= LevelCritical:
+		severity = "crit"
+	case r.Level >= slog.LevelError:
+		severity = "err"
+	}
+	attrs := make(map[string]string)
+	for _, a := range h.attrs {
+		attrs[a.Key] = a.Value.String()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+	h.l.mu.Lock()
+	defer h.l.mu.Unlock()
+	h.l.logs = append(h.l.logs, logEntry{severity, r.Message, attrs})
 	return nil
 }
 
-func (l *localLogger) Crit(msg string) error {
-	l.logs = append(l.logs, logEntry{"crit", msg})
-	return nil
+func (h *localHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &localHandler{h.l, append(append([]slog.Attr{}, h.attrs...), attrs...)}
 }
 
-func (l *localLogger) Emerg(msg string) error {
-	l.logs = append(l.logs, logEntry{"emerg", msg})
-	return nil
+func (h *localHandler) WithGroup(string) slog.Handler {
+	return h
 }
 
 type Suite struct {
@@ -67,7 +90,8 @@ func NewSuite(t *testing.T) *Suite {
 
 func NewSuiteWithDev(t *testing.T, dev io.ReadWriter) *Suite {
 	logger := &localLogger{}
-	handler := &PollenServer{randomSource: dev, log: logger, readSize: 64}
+	handler := &PollenServer{randomSource: dev, log: slog.New(&localHandler{l: logger})}
+	handler.readSize.Store(64)
 	return &Suite{httptest.NewServer(handler), t, dev, logger, handler}
 }
 
@@ -261,7 +285,7 @@ func TestSizeMatters(t *testing.T) {
 	s := NewSuiteWithDev(t, b)
 	defer s.TearDown()
 
-	s.pollen.readSize = 32
+	s.pollen.readSize.Store(32)
 	res, err := http.Get(s.URL + "?challenge=xxx")
 	s.Assert(err == nil, "http client error:", err)
 	defer res.Body.Close()
@@ -281,7 +305,7 @@ func TestExtraSize(t *testing.T) {
 	defer s.TearDown()
 
 	// We only start with 64 bytes of "nine" but we add the challenge to the pool
-	s.pollen.readSize = 128
+	s.pollen.readSize.Store(128)
 	res, err := http.Get(s.URL + "?challenge=xxx")
 	s.Assert(err == nil, "http client error:", err)
 	defer res.Body.Close()
@@ -318,15 +342,15 @@ func TestWriteFailure(t *testing.T) {
 	s.SanityCheck(chal, seed)
 	// Failing to write to the random device is logged
 	s.Assert(len(s.logger.logs) == 3, "expected 3 log messages, got:", len(s.logger.logs))
-	start := "Cannot write to random device at ["
+	start := "Cannot write to random device"
 	s.Assert(s.logger.logs[0].severity == "err" &&
 		s.logger.logs[0].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[0])
-	start = "Server received challenge from ["
+	start = "Server received challenge"
 	s.Assert(s.logger.logs[1].severity == "info" &&
 		s.logger.logs[1].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[1])
-	start = "Server sent response to ["
+	start = "Server sent response"
 	s.Assert(s.logger.logs[2].severity == "info" &&
 		s.logger.logs[2].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[2])
@@ -355,11 +379,11 @@ func TestReadFailure(t *testing.T) {
 	s.Assert(errMsg == "Failed to read from random device", "wrong error: ", errMsg)
 	s.Assert(res.StatusCode == http.StatusInternalServerError, "wrong status: ", res.Status)
 	s.Assert(len(s.logger.logs) == 2, "expected 2 log messages, got: ", len(s.logger.logs))
-	start := "Server received challenge from ["
+	start := "Server received challenge"
 	s.Assert(s.logger.logs[0].severity == "info" &&
 		s.logger.logs[0].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[0])
-	start = "Cannot read from random device at ["
+	start = "Cannot read from random device"
 	s.Assert(s.logger.logs[1].severity == "err" &&
 		s.logger.logs[1].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[1])
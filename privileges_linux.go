@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges switches every thread to the given user and group, clears
+// the supplementary groups and capabilities, and then checks that all of it
+// took effect and cannot be undone. group defaults to the user's primary
+// group.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid, err := lookupIDs(userName, groupName)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return errors.New("refusing to drop privileges to root")
+	}
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("cannot clear supplementary groups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("cannot set group id %d: %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("cannot set user id %d: %s", uid, err)
+	}
+	// Changing from root to another user clears the capabilities, but not if
+	// they came from file capabilities on the binary, so clear them
+	// explicitly as well. This can fail when built with cgo, in which case
+	// the check below decides.
+	clearCapabilities()
+	return checkPrivileges(uid, gid)
+}
+
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+func clearCapabilities() {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0)
+	syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+}
+
+// checkPrivileges fails unless every thread of the process runs as uid and
+// gid with no supplementary groups and no capabilities, and root can't be
+// regained.
+func checkPrivileges(uid, gid int) error {
+	if groups, err := syscall.Getgroups(); err != nil || len(groups) != 0 {
+		return fmt.Errorf("supplementary groups were not cleared: %v", groups)
+	}
+	if err := syscall.Setuid(0); err == nil {
+		return errors.New("root privileges could be regained")
+	}
+	tasks, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil || len(tasks) == 0 {
+		return fmt.Errorf("cannot check thread credentials: %v", err)
+	}
+	for _, task := range tasks {
+		if err := checkTaskStatus(task, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTaskStatus checks the credentials in a /proc/<pid>/task/<tid>/status
+// file: all of the real, effective, saved and filesystem ids and an empty
+// set for every kind of capability.
+func checkTaskStatus(path string, uid, gid int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	want := map[string]string{
+		"Uid:":    strings.Repeat(strconv.Itoa(uid)+" ", 4),
+		"Gid:":    strings.Repeat(strconv.Itoa(gid)+" ", 4),
+		"CapInh:": "0000000000000000 ",
+		"CapPrm:": "0000000000000000 ",
+		"CapEff:": "0000000000000000 ",
+		"CapAmb:": "0000000000000000 ",
+	}
+	seen := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		expected, ok := want[fields[0]]
+		if !ok {
+			continue
+		}
+		seen++
+		if got := strings.Join(fields[1:], " ") + " "; got != expected {
+			return fmt.Errorf("%s has %s %s, expected %s", path, fields[0], got, expected)
+		}
+	}
+	if seen != len(want) {
+		return fmt.Errorf("cannot read credentials from %s", path)
+	}
+	return scanner.Err()
+}
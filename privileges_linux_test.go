@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+// TestDropPrivilegesHelper is run in a child process by TestDropPrivileges,
+// since dropping privileges can't be undone.
+func TestDropPrivilegesHelper(t *testing.T) {
+	if os.Getenv("POLLEN_TEST_DROP_TO") == "" {
+		t.Skip("only run as a helper process")
+	}
+	if err := dropPrivileges(os.Getenv("POLLEN_TEST_DROP_TO"), ""); err != nil {
+		t.Fatalf("dropPrivileges failed: %s", err)
+	}
+	if _, err := os.Open("/proc/1/root/."); err == nil {
+		t.Error("still able to open files only root can")
+	}
+}
+
+// TestDropPrivileges drops from root to nobody in a child process.
+func TestDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("no nobody user")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), "POLLEN_TEST_DROP_TO=nobody")
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: TestDropPrivilegesHelper") {
+		t.Errorf("helper failed: %v\n%s", err, out)
+	}
+}
+
+// TestDropPrivilegesToRoot checks that dropping to root is refused rather
+// than silently keeping every privilege.
+func TestDropPrivilegesToRoot(t *testing.T) {
+	if err := dropPrivileges("root", ""); err == nil {
+		t.Error("expected dropping to root to be refused")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func dropPrivileges(userName, groupName string) error {
+	return errors.New("dropping privileges is only supported on Linux")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProxyConfig struct {
+	// Trusted lists the CIDRs of proxies whose X-Forwarded-For and Forwarded
+	// headers, and PROXY protocol headers, are believed
+	Trusted []string `yaml:"trusted"`
+}
+
+// proxyHeaderTimeout bounds how long a PROXY protocol header may take to
+// arrive before the connection is dropped.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyPeer  = errors.New("PROXY protocol header from an untrusted peer")
+)
+
+// proxyListener reads a PROXY protocol v1 or v2 header at the start of every
+// connection, which then reports the client the proxy forwarded as its
+// remote address.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{ln, trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), trusted: l.trusted}, nil
+}
+
+// proxyConn parses the header on first use rather than in Accept, so that a
+// slow proxy only holds up its own connection.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted []*net.IPNet
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if ip := addrIP(c.remote); ip != nil && !containsIP(c.trusted, ip) {
+			c.err = errProxyPeer
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		var addr net.Addr
+		addr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+	if c.err != nil {
+		// drop the connection rather than answer whoever is behind it
+		c.Conn.Close()
+	}
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// addrIP returns the IP address of a TCP or UDP address, nil otherwise.
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// readProxyHeader reads a PROXY protocol header, returning the source
+// address it gives, or nil for a health check or an unknown protocol.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil && !bytes.HasPrefix(sig, proxyV1Prefix) {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 parses a header such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324
+// 443\r\n", at most 107 bytes long.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header: the signature, version and command,
+// address family, length and the addresses themselves.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch hdr[12] & 0xf {
+	case 0:
+		// LOCAL, the proxy's own connection such as a health check
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", hdr[12]&0xf)
+	}
+	// only TCP and UDP over IPv4 and IPv6 carry an address pollen can use
+	switch hdr[13] {
+	case 0x11, 0x12:
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21, 0x22:
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
+
+type clientKey struct{}
+
+// clientAddr returns the address of the client that sent the request, as
+// resolved through any trusted proxies.
+func clientAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// withClientAddr resolves the client address of a request and carries it in
+// the request context.
+func withClientAddr(r *http.Request, trusted []*net.IPNet) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, resolveClient(r, trusted)))
+}
+
+// resolveClient walks the addresses in the Forwarded header, or failing that
+// X-Forwarded-For, from the nearest hop back while they are trusted proxies.
+// The first untrusted address is the client. Headers are ignored unless the
+// peer itself is a trusted proxy.
+func resolveClient(r *http.Request, trusted []*net.IPNet) string {
+	addr := r.RemoteAddr
+	if len(trusted) == 0 || !containsIP(trusted, parseHost(addr)) {
+		return addr
+	}
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if hops == nil {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, h := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(h))
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHost(hops[i])
+		if ip == nil {
+			// obfuscated or garbled, so the last trusted hop is all we know
+			break
+		}
+		addr = hops[i]
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded headers.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHost parses an address with or without a port, and IPv6 addresses
+// with or without brackets.
+func parseHost(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+}
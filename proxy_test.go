@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		t.Fatalf("parseCIDRs failed: %s", err)
+	}
+	return nets
+}
+
+// TestReadProxyHeader checks PROXY protocol v1 and v2 headers, and that the
+// data after them is left to read.
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr []byte) string {
+		var b bytes.Buffer
+		b.Write(proxyV2Sig)
+		b.WriteByte(0x20 | cmd)
+		b.WriteByte(fam)
+		binary.Write(&b, binary.BigEndian, uint16(len(addr)))
+		b.Write(addr)
+		return b.String()
+	}
+	ipv4 := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()...), 0xdc, 0x04, 0x01, 0xbb)
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	for _, tc := range []struct {
+		name   string
+		header string
+		addr   string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", true},
+		{"v1 garbled", "PROXY TCP4 nonsense\r\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("x", 200) + "\r\n", "", true},
+		{"v2 ipv4", v2(1, 0x11, ipv4), "192.0.2.1:56324", false},
+		{"v2 ipv6", v2(1, 0x21, ipv6), "[2001:db8::1]:56324", false},
+		{"v2 local", v2(0, 0, nil), "", false},
+		{"v2 short", v2(1, 0x11, ipv4[:6]), "", true},
+		{"missing", "GET / HTTP/1.1\r\n", "", true},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.header + "rest"))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		if got := fmt.Sprint(addr); addr != nil && got != tc.addr || addr == nil && tc.addr != "" {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.addr, got)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("%s: header not fully consumed, left %q", tc.name, rest)
+		}
+	}
+}
+
+// TestResolveClient checks the forwarding headers are only believed from
+// trusted proxies, back to the first untrusted hop.
+func TestResolveClient(t *testing.T) {
+	trusted := mustCIDRs(t, "10.0.0.0/8", "2001:db8:ffff::/48")
+	for _, tc := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		client  string
+	}{
+		{"no headers", "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"untrusted peer", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1:1234"},
+		{"x-forwarded-for", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed chain", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8:ffff::1]:4711"`, "X-Forwarded-For": "203.0.113.9"}, "198.51.100.1"},
+		{"forwarded ipv6", "[2001:db8:ffff::2]:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711"`}, "[2001:db8::1]:4711"},
+		{"obfuscated", "10.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"}, "10.0.0.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if got := resolveClient(r, trusted); got != tc.client {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.client, got)
+		}
+	}
+}
+
+// TestProxyProtocolListener serves pollen through a PROXY protocol listener
+// and checks the client in the header is the one logged, and that a peer
+// that isn't trusted is refused.
+func TestProxyProtocolListener(t *testing.T) {
+	for _, tc := range []struct {
+		trusted string
+		ok      bool
+	}{
+		{"127.0.0.0/8", true},
+		{"192.0.2.0/24", false},
+	} {
+		s := NewSuite(t)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen: %s", err)
+		}
+		server := &http.Server{Handler: s.pollen.listenerHandler(ListenerSpec{Name: "proxied", Routes: []string{"entropy"}})}
+		go server.Serve(newProxyListener(ln, mustCIDRs(t, tc.trusted)))
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("cannot connect: %s", err)
+		}
+		fmt.Fprintf(conn, "PROXY TCP4 198.51.100.7 127.0.0.1 40000 80\r\nGET /?challenge=xxx HTTP/1.1\r\nHost: pollen\r\nConnection: close\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if tc.ok {
+			s.Assert(err == nil && res.StatusCode == http.StatusOK, "proxied request failed: ", err)
+			found := false
+			for _, l := range s.logger.logs {
+				found = found || l.attrs["client"] == "198.51.100.7:40000"
+			}
+			s.Assert(found, "client address from the PROXY header not logged: ", s.logger.logs)
+		} else {
+			s.Assert(err != nil, "request from an untrusted peer was served")
+		}
+		conn.Close()
+		server.Close()
+		s.TearDown()
+	}
+}
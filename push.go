@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type PushConfig struct {
+	// Interval is how often the metrics are pushed
+	Interval time.Duration `yaml:"interval"`
+	// Labels are added to every metric pushed, to tell instances apart
+	Labels map[string]string `yaml:"labels"`
+	// CA is a PEM file of the CAs HTTPS targets' certificates are checked
+	// against, the system's if empty
+	CA          string            `yaml:"ca"`
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	Pushgateway PushgatewayConfig `yaml:"pushgateway"`
+	StatsD      StatsDConfig      `yaml:"statsd"`
+}
+
+type RemoteWriteConfig struct {
+	// URL is the Prometheus remote write endpoint, e.g.
+	// http://localhost:9090/api/v1/write, or empty not to push there
+	URL string `yaml:"url"`
+}
+
+type PushgatewayConfig struct {
+	// URL is the Pushgateway's, or empty not to push there
+	URL string `yaml:"url"`
+	// Job is the job the metrics are grouped under
+	Job string `yaml:"job"`
+}
+
+type StatsDConfig struct {
+	// Address is the StatsD server's host:port, or empty not to push there
+	Address string `yaml:"address"`
+	// Prefix is prepended to every metric name
+	Prefix string `yaml:"prefix"`
+	// DogStatsD sends labels as DogStatsD tags rather than folding them
+	// into the metric names
+	DogStatsD bool `yaml:"dogstatsd"`
+}
+
+const (
+	pushTimeout = 10 * time.Second
+	// statsdPacketSize keeps StatsD datagrams within an Ethernet frame
+	statsdPacketSize = 1432
+)
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// enabled reports whether metrics are pushed anywhere.
+func (c PushConfig) enabled() bool {
+	return c.RemoteWrite.URL != "" || c.Pushgateway.URL != "" || c.StatsD.Address != ""
+}
+
+// validate checks the push targets and labels.
+func (c PushConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Interval <= 0 {
+		return errors.New("metrics push interval must be positive")
+	}
+	for name := range c.Labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid metrics push label %q", name)
+		}
+	}
+	for _, u := range []string{c.RemoteWrite.URL, c.Pushgateway.URL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid metrics push URL %q", u)
+		}
+	}
+	if c.Pushgateway.URL != "" && c.Pushgateway.Job == "" {
+		return errors.New("metrics pushgateway needs a job")
+	}
+	if c.StatsD.Address != "" {
+		if _, _, err := net.SplitHostPort(c.StatsD.Address); err != nil {
+			return fmt.Errorf("metrics statsd address: %s", err)
+		}
+	}
+	return nil
+}
+
+// pushTarget is somewhere the metrics are pushed.
+type pushTarget interface {
+	push(ctx context.Context, families []*dto.MetricFamily, now time.Time) error
+}
+
+// StartPush pushes the metrics to the configured targets every interval,
+// from a goroutine of its own. Failures are logged when a target starts and
+// stops failing. It returns an error if the CAs for HTTPS targets can't be
+// loaded. If the Tracker receiver is nil, the function does nothing.
+func (t *Tracker) StartPush(cfg PushConfig, log *slog.Logger) error {
+	if t == nil || !cfg.enabled() {
+		return nil
+	}
+	// the CAs are loaded now, while pollen can still read them
+	roots, err := x509.SystemCertPool()
+	if cfg.CA != "" {
+		roots = x509.NewCertPool()
+		var pem []byte
+		if pem, err = os.ReadFile(cfg.CA); err == nil && !roots.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificates in %s", cfg.CA)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	client := &http.Client{Transport: transport, Timeout: pushTimeout}
+	targets := make(map[string]pushTarget)
+	if cfg.RemoteWrite.URL != "" {
+		targets["remote_write"] = &remoteWriter{cfg.RemoteWrite.URL, cfg.Labels, client}
+	}
+	if cfg.Pushgateway.URL != "" {
+		p := push.New(cfg.Pushgateway.URL, cfg.Pushgateway.Job).Gatherer(t.registry).Client(client)
+		for name, value := range cfg.Labels {
+			p = p.Grouping(name, value)
+		}
+		targets["pushgateway"] = pushgateway{p}
+	}
+	if cfg.StatsD.Address != "" {
+		targets["statsd"] = &statsdPusher{cfg: cfg.StatsD, labels: cfg.Labels, last: make(map[string]float64)}
+	}
+	go func() {
+		failing := make(map[string]bool)
+		for now := range time.Tick(cfg.Interval) {
+			families, err := t.registry.Gather()
+			if err != nil {
+				log.Warn("Cannot gather metrics to push", "error", err)
+				continue
+			}
+			for name, target := range targets {
+				ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+				err := target.push(ctx, families, now)
+				cancel()
+				switch {
+				case err != nil && !failing[name]:
+					log.Warn("Cannot push metrics", "target", name, "error", err)
+				case err == nil && failing[name]:
+					log.Info("Pushing metrics again", "target", name)
+				}
+				failing[name] = err != nil
+			}
+		}
+	}()
+	return nil
+}
+
+// sample is a single value of a metric family, as the exposition formats
+// flatten them: histograms and summaries become several series.
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+	// counter is set for values that only go up
+	counter bool
+}
+
+// flatten turns metric families into samples, adding extra to the labels.
+func flatten(families []*dto.MetricFamily, extra map[string]string) []sample {
+	var samples []sample
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for name, value := range extra {
+				labels[name] = value
+			}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			with := func(name, value string) map[string]string {
+				l := make(map[string]string, len(labels)+1)
+				for k, v := range labels {
+					l[k] = v
+				}
+				l[name] = value
+				return l
+			}
+			name := f.GetName()
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, sample{name, labels, m.GetCounter().GetValue(), true})
+			case dto.MetricType_GAUGE:
+				samples = append(samples, sample{name, labels, m.GetGauge().GetValue(), false})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, sample{name, labels, m.GetUntyped().GetValue(), false})
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					samples = append(samples, sample{name + "_bucket", with("le", formatFloat(b.GetUpperBound())), float64(b.GetCumulativeCount()), true})
+				}
+				samples = append(samples,
+					sample{name + "_bucket", with("le", "+Inf"), float64(h.GetSampleCount()), true},
+					sample{name + "_sum", labels, h.GetSampleSum(), true},
+					sample{name + "_count", labels, float64(h.GetSampleCount()), true})
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					samples = append(samples, sample{name, with("quantile", formatFloat(q.GetQuantile())), q.GetValue(), false})
+				}
+				samples = append(samples,
+					sample{name + "_sum", labels, s.GetSampleSum(), true},
+					sample{name + "_count", labels, float64(s.GetSampleCount()), true})
+			}
+		}
+	}
+	return samples
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedLabels returns the label names in order.
+func sortedLabels(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// remoteWriter pushes with the Prometheus remote write protocol: a
+// snappy-compressed protobuf WriteRequest.
+type remoteWriter struct {
+	url    string
+	labels map[string]string
+	client *http.Client
+}
+
+func (r *remoteWriter) push(ctx context.Context, families []*dto.MetricFamily, now time.Time) error {
+	body := snappyEncode(writeRequest(flatten(families, r.labels), now))
+	req, err := http.NewRequestWithContext(ctx, "POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("remote write returned %s", res.Status)
+	}
+	return nil
+}
+
+// writeRequest encodes samples as a prometheus.WriteRequest: repeated
+// TimeSeries timeseries = 1, each with repeated Label labels = 1 (string name
+// = 1, string value = 2) sorted by name, and repeated Sample samples = 2
+// (double value = 1, int64 timestamp = 2 in milliseconds).
+func writeRequest(samples []sample, now time.Time) []byte {
+	var b []byte
+	for _, s := range samples {
+		var ts []byte
+		labels := map[string]string{"__name__": s.name}
+		for name, value := range s.labels {
+			labels[name] = value
+		}
+		for _, name := range sortedLabels(labels) {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var v []byte
+		v = protowire.AppendTag(v, 1, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(s.value))
+		v = protowire.AppendTag(v, 2, protowire.VarintType)
+		v = protowire.AppendVarint(v, uint64(now.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, v)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+// snappyEncode frames src in the snappy block format as literals only. It
+// doesn't compress, but any snappy decoder reads it, without pulling in a
+// compression library for a few kilobytes every interval.
+func snappyEncode(src []byte) []byte {
+	dst := protowire.AppendVarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		// a literal of up to 2^16 bytes takes a tag and two length bytes
+		n := min(len(src), 1<<16)
+		if n <= 60 {
+			dst = append(dst, byte(n-1)<<2)
+		} else {
+			dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+// pushgateway pushes to a Pushgateway, replacing what was pushed before.
+type pushgateway struct {
+	pusher *push.Pusher
+}
+
+func (p pushgateway) push(ctx context.Context, _ []*dto.MetricFamily, _ time.Time) error {
+	return p.pusher.PushContext(ctx)
+}
+
+// statsdPusher sends gauges as they are and counters as the increase since
+// the last push, over UDP.
+type statsdPusher struct {
+	cfg    StatsDConfig
+	labels map[string]string
+	// last holds the counters' values at the last push, by metric line
+	last map[string]float64
+}
+
+// statsdName makes a name safe for StatsD, which uses : | @ and # as
+// separators.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// line formats a sample as a StatsD metric, without its value.
+func (p *statsdPusher) line(s sample) string {
+	name := p.cfg.Prefix + s.name
+	var tags []string
+	for _, label := range sortedLabels(s.labels) {
+		if p.cfg.DogStatsD {
+			tags = append(tags, statsdName(label)+":"+statsdName(s.labels[label]))
+		} else {
+			name += "." + label + "." + s.labels[label]
+		}
+	}
+	if len(tags) > 0 {
+		return statsdName(name) + "|#" + strings.Join(tags, ",")
+	}
+	return statsdName(name)
+}
+
+func (p *statsdPusher) push(ctx context.Context, families []*dto.MetricFamily, _ time.Time) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", p.cfg.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, s := range flatten(families, p.labels) {
+		key := p.line(s)
+		name, tags, _ := strings.Cut(key, "|")
+		var metric string
+		if s.counter {
+			delta := s.value - p.last[key]
+			p.last[key] = s.value
+			if delta <= 0 {
+				continue
+			}
+			metric = fmt.Sprintf("%s:%s|c", name, formatFloat(delta))
+		} else {
+			metric = fmt.Sprintf("%s:%s|g", name, formatFloat(s.value))
+		}
+		if tags != "" {
+			metric += "|" + tags
+		}
+		if packet.Len() > 0 && packet.Len()+1+len(metric) > statsdPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(metric)
+	}
+	return flush()
+}
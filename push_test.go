@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// quietLog keeps the pushers of finished tests from logging their failures.
+var quietLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// TestPushConfig checks push targets are validated.
+func TestPushConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  PushConfig
+		ok   bool
+	}{
+		{"none", PushConfig{}, true},
+		{"remote write", PushConfig{Interval: time.Second, RemoteWrite: RemoteWriteConfig{URL: "http://localhost:9090/api/v1/write"}}, true},
+		{"bad url", PushConfig{Interval: time.Second, RemoteWrite: RemoteWriteConfig{URL: "localhost:9090"}}, false},
+		{"no job", PushConfig{Interval: time.Second, Pushgateway: PushgatewayConfig{URL: "http://localhost:9091"}}, false},
+		{"statsd", PushConfig{Interval: time.Second, StatsD: StatsDConfig{Address: "localhost:8125"}}, true},
+		{"bad statsd", PushConfig{Interval: time.Second, StatsD: StatsDConfig{Address: "localhost"}}, false},
+		{"no interval", PushConfig{StatsD: StatsDConfig{Address: "localhost:8125"}}, false},
+		{"label", PushConfig{Interval: time.Second, Labels: map[string]string{"instance": "a"}, StatsD: StatsDConfig{Address: "localhost:8125"}}, true},
+		{"bad label", PushConfig{Interval: time.Second, Labels: map[string]string{"in-stance": "a"}, StatsD: StatsDConfig{Address: "localhost:8125"}}, false},
+		{"reserved label", PushConfig{Interval: time.Second, Labels: map[string]string{"__name__": "a"}, StatsD: StatsDConfig{Address: "localhost:8125"}}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected result: %v", tc.name, err)
+		}
+	}
+}
+
+// snappyDecode reads the snappy block format, as far as snappyEncode writes
+// it.
+func snappyDecode(t *testing.T, src []byte) []byte {
+	n, l := protowire.ConsumeVarint(src)
+	src = src[l:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected snappy copy tag %x", tag)
+		}
+		size := int(tag>>2) + 1
+		src = src[1:]
+		if size > 60 {
+			b := make([]byte, 4)
+			copy(b, src[:size-60])
+			src = src[size-60:]
+			size = int(binary.LittleEndian.Uint32(b)) + 1
+		}
+		dst = append(dst, src[:size]...)
+		src = src[size:]
+	}
+	if uint64(len(dst)) != n {
+		t.Fatalf("snappy length %d, decoded %d", n, len(dst))
+	}
+	return dst
+}
+
+// decodeWriteRequest returns the series in a WriteRequest by their sorted
+// labels, in the text format's notation.
+func decodeWriteRequest(t *testing.T, b []byte) map[string]float64 {
+	// fields walks the fields of a message, passing on their raw values
+	fields := func(b []byte, f func(num protowire.Number, v []byte, fixed uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("bad tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				f(num, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				f(num, nil, v)
+				b = b[n:]
+			case protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				f(num, nil, v)
+				b = b[n:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+	series := make(map[string]float64)
+	fields(b, func(_ protowire.Number, ts []byte, _ uint64) {
+		var labels []string
+		var value float64
+		fields(ts, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				fields(v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				labels = append(labels, name+"="+value)
+			case 2:
+				fields(v, func(num protowire.Number, _ []byte, fixed uint64) {
+					if num == 1 {
+						value = math.Float64frombits(fixed)
+					}
+				})
+			}
+		})
+		series[strings.Join(labels, ",")] = value
+	})
+	return series
+}
+
+// TestRemoteWrite pushes to a stand-in remote write receiver.
+func TestRemoteWrite(t *testing.T) {
+	received := make(chan map[string]float64, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") == "" {
+			http.Error(w, "bad headers", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- decodeWriteRequest(t, snappyDecode(t, body))
+	}))
+	defer receiver.Close()
+
+	tracker := NewTracker(prometheus.NewRegistry(), HistogramsConfig{})
+	tracker.RequestReceived("test")
+	tracker.StartPush(PushConfig{
+		Interval:    10 * time.Millisecond,
+		Labels:      map[string]string{"instance": "pollen-1"},
+		RemoteWrite: RemoteWriteConfig{URL: receiver.URL},
+	}, quietLog)
+
+	select {
+	case series := <-received:
+		key := "__name__=pollen_http_requests_total,instance=pollen-1,listener=test"
+		if series[key] != 1 {
+			t.Errorf("%s not pushed: %v", key, series)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing pushed")
+	}
+}
+
+// TestRemoteWriteHTTPS pushes to a receiver over HTTPS, trusting its
+// certificate through push.ca.
+func TestRemoteWriteHTTPS(t *testing.T) {
+	received := make(chan struct{}, 10)
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer receiver.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: receiver.Certificate().Raw}), 0644)
+
+	tracker := NewTracker(prometheus.NewRegistry(), HistogramsConfig{})
+	err := tracker.StartPush(PushConfig{
+		Interval:    10 * time.Millisecond,
+		CA:          ca,
+		RemoteWrite: RemoteWriteConfig{URL: receiver.URL},
+	}, quietLog)
+	if err != nil {
+		t.Fatalf("StartPush failed: %s", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing pushed")
+	}
+	if err := tracker.StartPush(PushConfig{Interval: time.Second, CA: "/nonexistent", RemoteWrite: RemoteWriteConfig{URL: receiver.URL}}, quietLog); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
+
+// TestSnappyLongLiteral checks literals longer than the tag holds.
+func TestSnappyLongLiteral(t *testing.T) {
+	for _, n := range []int{1, 60, 61, 1000, 1<<16 + 1} {
+		src := []byte(strings.Repeat("x", n))
+		if got := snappyDecode(t, snappyEncode(src)); string(got) != string(src) {
+			t.Errorf("%d bytes: round trip failed", n)
+		}
+	}
+}
+
+// TestPushgateway pushes to a stand-in Pushgateway.
+func TestPushgateway(t *testing.T) {
+	received := make(chan string, 10)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == "PUT" && len(body) > 0 {
+			received <- r.URL.Path
+		}
+	}))
+	defer gateway.Close()
+
+	tracker := NewTracker(prometheus.NewRegistry(), HistogramsConfig{})
+	tracker.StartPush(PushConfig{
+		Interval:    10 * time.Millisecond,
+		Labels:      map[string]string{"instance": "pollen-1"},
+		Pushgateway: PushgatewayConfig{URL: gateway.URL, Job: "pollen"},
+	}, quietLog)
+
+	select {
+	case path := <-received:
+		if path != "/metrics/job/pollen/instance/pollen-1" {
+			t.Errorf("wrong grouping: %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing pushed")
+	}
+}
+
+// TestStatsD pushes to a UDP socket, checking counters are sent as their
+// increase and labels as DogStatsD tags.
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer conn.Close()
+
+	tracker := NewTracker(prometheus.NewRegistry(), HistogramsConfig{})
+	tracker.RequestReceived("test")
+	tracker.RequestReceived("test")
+	tracker.StartPush(PushConfig{
+		Interval: 10 * time.Millisecond,
+		Labels:   map[string]string{"instance": "pollen-1"},
+		StatsD:   StatsDConfig{Address: conn.LocalAddr().String(), Prefix: "pollen.", DogStatsD: true},
+	}, quietLog)
+
+	want := []string{
+		"pollen.pollen_http_requests_total:2|c|#instance:pollen-1,listener:test",
+		"pollen.pollen_http_requests_total:1|c|#instance:pollen-1,listener:test",
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	for len(want) > 0 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("still waiting for %v: %s", want, err)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line == want[0] {
+				want = want[1:]
+				// the next push should only carry the next request
+				tracker.RequestReceived("test")
+				break
+			}
+		}
+	}
+}
+
+// TestStatsDName checks labels are folded into plain StatsD names.
+func TestStatsDName(t *testing.T) {
+	p := &statsdPusher{cfg: StatsDConfig{Prefix: "pollen."}}
+	got := p.line(sample{name: "pollen_http_requests_total", labels: map[string]string{"listener": "a:b", "code": "200"}})
+	if got != "pollen.pollen_http_requests_total.code.200.listener.a_b" {
+		t.Errorf("unexpected name: %s", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Rate is the sustained number of requests per second for each client
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of requests a client can make at once
+	Burst int `yaml:"burst"`
+	// MaxClients bounds the memory used, the least recently seen clients are
+	// forgotten first
+	MaxClients int `yaml:"max_clients"`
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by, since a
+	// single host usually has a whole /64
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+	// Allow lists CIDRs that are never limited, e.g. load balancers
+	Allow []string `yaml:"allow"`
+}
+
+// RateLimiter keeps a token bucket for each client address.
+type RateLimiter struct {
+	rate       float64
+	burst      float64
+	maxClients int
+	ipv6Mask   net.IPMask
+	allow      []*net.IPNet
+	now        func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// parseCIDRs parses a list of CIDRs, accepting plain addresses as a single
+// host.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the rate limit settings.
+func (c RateLimitConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Rate <= 0 || c.Burst < 1 {
+		return fmt.Errorf("rate limit rate and burst must be positive")
+	}
+	if c.MaxClients < 1 {
+		return fmt.Errorf("rate limit max_clients must be positive")
+	}
+	if c.IPv6Prefix < 1 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid rate limit ipv6_prefix: %d", c.IPv6Prefix)
+	}
+	_, err := parseCIDRs(c.Allow)
+	return err
+}
+
+// NewRateLimiter creates a RateLimiter, or returns nil if rate limiting is
+// disabled.
+func NewRateLimiter(cfg RateLimitConfig) (*RateLimiter, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	allow, _ := parseCIDRs(cfg.Allow)
+	return &RateLimiter{
+		rate:       cfg.Rate,
+		burst:      float64(cfg.Burst),
+		maxClients: cfg.MaxClients,
+		ipv6Mask:   net.CIDRMask(cfg.IPv6Prefix, 128),
+		allow:      allow,
+		now:        time.Now,
+		clients:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}, nil
+}
+
+// clientKey groups IPv6 addresses by the configured prefix.
+func (l *RateLimiter) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(l.ipv6Mask).String()
+}
+
+// Allow takes a token from the client's bucket. If there is none it returns
+// false and how long until there will be. If the RateLimiter receiver is
+// nil, or the client has no IP address, every request is allowed.
+func (l *RateLimiter) Allow(ip net.IP) (bool, time.Duration) {
+	if l == nil || ip == nil || containsIP(l.allow, ip) {
+		return true, 0
+	}
+	key := l.clientKey(ip)
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *bucket
+	if e, ok := l.clients[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.maxClients {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.clients, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.clients[key] = l.lru.PushFront(b)
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Clients returns the number of clients currently tracked.
+func (l *RateLimiter) Clients() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+// clientIP returns the IP address of the client that sent the request, or
+// nil if it has none, e.g. on a Unix socket.
+func clientIP(r *http.Request) net.IP {
+	return parseHost(clientAddr(r))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T, cfg RateLimitConfig) (*RateLimiter, *time.Time) {
+	cfg.Enabled = true
+	if cfg.MaxClients == 0 {
+		cfg.MaxClients = 100
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = 64
+	}
+	l, err := NewRateLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewRateLimiter failed: %s", err)
+	}
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+// TestRateLimiterBucket checks the burst, the wait reported once it is used
+// up and the refill.
+func TestRateLimiterBucket(t *testing.T) {
+	l, now := newTestLimiter(t, RateLimitConfig{Rate: 0.5, Burst: 3})
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(ip); !ok {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	ok, wait := l.Allow(ip)
+	if ok || wait != 2*time.Second {
+		t.Errorf("expected a refusal with a 2s wait, got: %v %s", ok, wait)
+	}
+	if ok, _ := l.Allow(net.ParseIP("192.0.2.2")); !ok {
+		t.Error("another client was refused")
+	}
+	*now = now.Add(2 * time.Second)
+	if ok, _ := l.Allow(ip); !ok {
+		t.Error("request after the refill was refused")
+	}
+	if ok, _ := l.Allow(ip); ok {
+		t.Error("refill gave more than one token")
+	}
+}
+
+// TestRateLimiterIPv6Prefix checks that addresses in the same /64 share a
+// bucket.
+func TestRateLimiterIPv6Prefix(t *testing.T) {
+	l, _ := newTestLimiter(t, RateLimitConfig{Rate: 1, Burst: 1})
+	if ok, _ := l.Allow(net.ParseIP("2001:db8:1:2::1")); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, _ := l.Allow(net.ParseIP("2001:db8:1:2:ffff::2")); ok {
+		t.Error("an address in the same /64 was not limited")
+	}
+	if ok, _ := l.Allow(net.ParseIP("2001:db8:1:3::1")); !ok {
+		t.Error("an address in another /64 was limited")
+	}
+}
+
+// TestRateLimiterAllowlist checks that allowlisted clients are never limited
+// or tracked.
+func TestRateLimiterAllowlist(t *testing.T) {
+	l, _ := newTestLimiter(t, RateLimitConfig{Rate: 1, Burst: 1, Allow: []string{"10.0.0.0/8", "192.0.2.7"}})
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow(net.ParseIP("10.1.2.3")); !ok {
+			t.Fatal("allowlisted network was limited")
+		}
+		if ok, _ := l.Allow(net.ParseIP("192.0.2.7")); !ok {
+			t.Fatal("allowlisted address was limited")
+		}
+	}
+	if l.Clients() != 0 {
+		t.Errorf("allowlisted clients were tracked: %d", l.Clients())
+	}
+}
+
+// TestRateLimiterEviction checks that the number of tracked clients stays
+// bounded, forgetting the least recently seen.
+func TestRateLimiterEviction(t *testing.T) {
+	l, _ := newTestLimiter(t, RateLimitConfig{Rate: 1, Burst: 1, MaxClients: 2})
+	a, b, c := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	l.Allow(a)
+	l.Allow(b)
+	l.Allow(a)
+	l.Allow(c)
+	if l.Clients() != 2 {
+		t.Errorf("expected 2 tracked clients, got: %d", l.Clients())
+	}
+	if ok, _ := l.Allow(b); !ok {
+		t.Error("b should have been evicted and start with a full bucket")
+	}
+	if ok, _ := l.Allow(c); ok {
+		t.Error("c should still be tracked")
+	}
+}
+
+// TestTooManyRequests checks the 429 response and its Retry-After header.
+func TestTooManyRequests(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.limiter, _ = newTestLimiter(t, RateLimitConfig{Rate: 0.1, Burst: 1})
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "first request failed: ", res.Status)
+	res, err = http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusTooManyRequests, "expected Too Many Requests, got: ", res.Status)
+	s.Assert(res.Header.Get("Retry-After") == "10", "wrong Retry-After: ", res.Header.Get("Retry-After"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// crngPollInterval is how often the kernel is asked whether its CRNG is
+// ready while pollen waits for it.
+const crngPollInterval = 100 * time.Millisecond
+
+// gateOnCRNG holds off serving entropy until ready reports the kernel's
+// CRNG is seeded, or until timeout has passed, since seeds handed out before
+// then may be predictable. A zero timeout doesn't wait at all. It returns
+// straight away, waiting in the background.
+func (p *PollenServer) gateOnCRNG(timeout time.Duration, ready func() bool) {
+	p.starting.Store(true)
+	p.tracker.Ready(false)
+	go p.waitForCRNG(time.Now(), timeout, ready)
+}
+
+func (p *PollenServer) waitForCRNG(start time.Time, timeout time.Duration, ready func() bool) {
+	defer func() {
+		p.starting.Store(false)
+		p.updateReady()
+	}()
+	for !ready() {
+		waited := time.Since(start)
+		if waited >= timeout {
+			p.log.Warn("Kernel CRNG is not ready, serving anyway", "waited", waited)
+			p.tracker.CRNGWaited(waited)
+			return
+		}
+		time.Sleep(min(crngPollInterval, timeout-waited))
+	}
+	waited := time.Since(start)
+	p.log.Info("Kernel CRNG is ready", "waited", waited)
+	p.tracker.CRNGWaited(waited)
+}
+
+// serveHealth answers liveness checks: pollen is up if it answers, even
+// while it is drained for maintenance, which it says.
+func (p *PollenServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if len(p.maintenance.active()) > 0 {
+		io.WriteString(w, "draining\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// updateReady reports whether pollen serves entropy in metrics.
+func (p *PollenServer) updateReady() {
+	p.tracker.Ready(!p.starting.Load() && len(p.maintenance.active()) == 0)
+}
+
+// serveReady answers readiness checks, failing while pollen doesn't serve
+// entropy.
+func (p *PollenServer) serveReady(w http.ResponseWriter, r *http.Request) {
+	if p.starting.Load() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	if len(p.maintenance.active()) > 0 {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitReady polls /readyz until it succeeds.
+func waitReady(t *testing.T, url string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		res, err := http.Get(url + "/readyz")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("never became ready")
+}
+
+// TestCRNGGate checks entropy and readiness are refused until the CRNG is
+// ready, while liveness never is.
+func TestCRNGGate(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy", "health", "ready"}}))
+	defer server.Close()
+
+	var crng atomic.Bool
+	s.pollen.gateOnCRNG(time.Minute, crng.Load)
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/?challenge=xxx", http.StatusServiceUnavailable},
+		{"/readyz", http.StatusServiceUnavailable},
+		{"/healthz", http.StatusOK},
+	} {
+		res, err := http.Get(server.URL + tc.path)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == tc.status, tc.path, "expected", tc.status, "got", res.StatusCode)
+		if tc.path == "/?challenge=xxx" {
+			s.Assert(res.Header.Get("Retry-After") != "", "no Retry-After while starting")
+		}
+	}
+
+	crng.Store(true)
+	waitReady(t, server.URL)
+	res, err := http.Get(server.URL + "/?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "entropy still refused once ready:", res.StatusCode)
+
+	s.logger.mu.Lock()
+	defer s.logger.mu.Unlock()
+	s.Assert(s.logger.logs[0].message == "Kernel CRNG is ready" && s.logger.logs[0].attrs["waited"] != "",
+		"readiness not logged:", s.logger.logs[0])
+}
+
+// TestCRNGGateTimeout checks pollen serves anyway once the timeout passes,
+// and says so.
+func TestCRNGGateTimeout(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"ready"}}))
+	defer server.Close()
+
+	s.pollen.gateOnCRNG(50*time.Millisecond, func() bool { return false })
+	waitReady(t, server.URL)
+	s.logger.mu.Lock()
+	defer s.logger.mu.Unlock()
+	s.Assert(strings.HasPrefix(s.logger.logs[0].message, "Kernel CRNG is not ready"), "timeout not logged:", s.logger.logs)
+}
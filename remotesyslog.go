@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type RemoteSyslogConfig struct {
+	// Network is udp, tcp or tls
+	Network string `yaml:"network"`
+	// Address is the collector's host:port
+	Address string `yaml:"address"`
+	// CA is a PEM file of the CAs the collector's certificate is checked
+	// against, the system's if empty
+	CA string `yaml:"ca"`
+	// Buffer is the number of messages held while the collector is slow or
+	// unreachable, beyond which they are dropped
+	Buffer int `yaml:"buffer"`
+}
+
+// validate checks the remote syslog settings.
+func (c RemoteSyslogConfig) validate() error {
+	switch c.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("unknown remote syslog network %q", c.Network)
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("remote syslog address: %s", err)
+	}
+	if c.Buffer < 1 {
+		return errors.New("remote syslog buffer must be positive")
+	}
+	return nil
+}
+
+const (
+	// syslogFacility is daemon
+	syslogFacility     = 3
+	remoteMinBackoff   = 100 * time.Millisecond
+	remoteMaxBackoff   = 30 * time.Second
+	remoteWriteTimeout = 10 * time.Second
+)
+
+// errRemoteFlush is returned when a critical message could not be sent
+// before pollen gave up waiting.
+var errRemoteFlush = errors.New("timed out sending a critical message to the remote collector")
+
+// remoteMessage is a queued message. If its sender waits for it to be sent,
+// done is closed once it is.
+type remoteMessage struct {
+	b    []byte
+	done chan struct{}
+}
+
+// remoteSyslog sends RFC 5424 messages to a collector from a goroutine of
+// its own, so that logging only waits on the network for the critical
+// messages pollen exits after.
+type remoteSyslog struct {
+	network  string
+	hostname string
+	dial     func() (net.Conn, error)
+	queue    chan remoteMessage
+	// dropped counts the messages that didn't fit in the queue since the
+	// collector was last told about them
+	dropped atomic.Int64
+	now     func() time.Time
+	// flushTimeout is how long a critical message waits to be sent
+	flushTimeout time.Duration
+}
+
+func newRemoteSyslog(cfg RemoteSyslogConfig) (*remoteSyslog, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	r := &remoteSyslog{network: cfg.Network, hostname: hostname, queue: make(chan remoteMessage, cfg.Buffer), now: time.Now, flushTimeout: remoteWriteTimeout}
+	dialer := &net.Dialer{Timeout: remoteWriteTimeout}
+	switch cfg.Network {
+	case "tls":
+		// the CAs are loaded now, while pollen can still read them
+		roots, err := x509.SystemCertPool()
+		if cfg.CA != "" {
+			roots = x509.NewCertPool()
+			var pem []byte
+			if pem, err = os.ReadFile(cfg.CA); err == nil && !roots.AppendCertsFromPEM(pem) {
+				err = fmt.Errorf("no certificates in %s", cfg.CA)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(cfg.Address)
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: host, MinVersion: tls.VersionTLS12}
+		r.dial = func() (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", cfg.Address, tlsConfig)
+		}
+	default:
+		r.dial = func() (net.Conn, error) {
+			return dialer.Dial(cfg.Network, cfg.Address)
+		}
+	}
+	go r.run()
+	return r, nil
+}
+
+// message formats an RFC 5424 message, without structured data since the
+// attributes are already in msg.
+func (r *remoteSyslog) message(level slog.Level, msg string) []byte {
+	return []byte(fmt.Sprintf("<%d>1 %s %s pollen %d - - %s", syslogFacility*8+syslogSeverity(level),
+		r.now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"), r.hostname, os.Getpid(), msg))
+}
+
+// send queues a message, dropping it if the queue is full. A critical
+// message, after which pollen exits, waits instead until it and the messages
+// queued before it are sent, for at most flushTimeout.
+func (r *remoteSyslog) send(level slog.Level, msg string) error {
+	m := remoteMessage{b: r.message(level, msg)}
+	if level < LevelCritical {
+		select {
+		case r.queue <- m:
+		default:
+			r.dropped.Add(1)
+		}
+		return nil
+	}
+	m.done = make(chan struct{})
+	timer := time.NewTimer(r.flushTimeout)
+	defer timer.Stop()
+	select {
+	case r.queue <- m:
+	case <-timer.C:
+		r.dropped.Add(1)
+		return errRemoteFlush
+	}
+	select {
+	case <-m.done:
+		return nil
+	case <-timer.C:
+		return errRemoteFlush
+	}
+}
+
+// frame prepares a message for the wire: a datagram for udp, and with
+// RFC 6587 octet counting for tcp and tls.
+func (r *remoteSyslog) frame(msg []byte) []byte {
+	if r.network == "udp" {
+		return msg
+	}
+	return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+}
+
+// run sends the queued messages, reconnecting with exponential backoff when
+// the collector can't be reached. A message that failed to send is retried
+// on the next connection.
+func (r *remoteSyslog) run() {
+	var conn net.Conn
+	var pending remoteMessage
+	backoff := remoteMinBackoff
+	for {
+		if pending.b == nil {
+			pending = <-r.queue
+		}
+		if conn == nil {
+			c, err := r.dial()
+			if err != nil {
+				time.Sleep(backoff)
+				backoff = min(2*backoff, remoteMaxBackoff)
+				continue
+			}
+			conn, backoff = c, remoteMinBackoff
+		}
+		conn.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+		if n := r.dropped.Load(); n > 0 {
+			notice := r.message(slog.LevelWarn, fmt.Sprintf("msg=\"Dropped log messages\" dropped=%d", n))
+			if _, err := conn.Write(r.frame(notice)); err != nil {
+				conn.Close()
+				conn = nil
+				continue
+			}
+			r.dropped.Add(-n)
+		}
+		if _, err := conn.Write(r.frame(pending.b)); err != nil {
+			conn.Close()
+			conn = nil
+			continue
+		}
+		if pending.done != nil {
+			close(pending.done)
+		}
+		pending = remoteMessage{}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFramed reads one octet counted message from a collector connection.
+func readFramed(t *testing.T, r *bufio.Reader) string {
+	var n int
+	if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+		t.Fatalf("cannot read frame length: %s", err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("cannot read frame: %s", err)
+	}
+	return string(b)
+}
+
+// acceptOne accepts a connection on ln with a deadline.
+func acceptOne(t *testing.T, ln net.Listener) *bufio.Reader {
+	type deadliner interface{ SetDeadline(time.Time) error }
+	if d, ok := ln.(deadliner); ok {
+		d.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("collector did not get a connection: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return bufio.NewReader(c)
+}
+
+func newRemoteLogger(t *testing.T, cfg RemoteSyslogConfig) *slog.Logger {
+	if cfg.Buffer == 0 {
+		cfg.Buffer = 16
+	}
+	h, err := newLogHandler(LogConfig{Backend: "remote", Remote: cfg}, slog.LevelInfo, nil)
+	if err != nil {
+		t.Fatalf("newLogHandler failed: %s", err)
+	}
+	return slog.New(h)
+}
+
+// TestRemoteSyslogTCP checks the RFC 5424 header and octet counting.
+func TestRemoteSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	log := newRemoteLogger(t, RemoteSyslogConfig{Network: "tcp", Address: ln.Addr().String()})
+	log.Error("Cannot read from random device", "client", "192.0.2.1")
+	log.Info("Server sent response")
+
+	r := acceptOne(t, ln)
+	msg := readFramed(t, r)
+	hostname, _ := os.Hostname()
+	prefix := "<27>1 "
+	if !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, fmt.Sprintf(" %s pollen %d - - ", hostname, os.Getpid())) ||
+		!strings.HasSuffix(msg, `msg="Cannot read from random device" client=192.0.2.1`) {
+		t.Errorf("unexpected message: %q", msg)
+	}
+	if msg = readFramed(t, r); !strings.HasPrefix(msg, "<30>1 ") {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
+
+// TestRemoteSyslogUDP checks a message is sent as a datagram of its own.
+func TestRemoteSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	newRemoteLogger(t, RemoteSyslogConfig{Network: "udp", Address: conn.LocalAddr().String()}).Warn("hello")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("no datagram: %s", err)
+	}
+	if msg := string(b[:n]); !strings.HasPrefix(msg, "<28>1 ") || !strings.HasSuffix(msg, `msg=hello`) {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
+
+// TestRemoteSyslogTLS checks the collector's certificate is verified
+// against the configured CA.
+func TestRemoteSyslogTLS(t *testing.T) {
+	opts := defaultCertOptions()
+	opts.hosts = []string{"127.0.0.1"}
+	certPEM, keyPEM, _, err := generateCert(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, certPEM, 0644)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	newRemoteLogger(t, RemoteSyslogConfig{Network: "tls", Address: ln.Addr().String(), CA: ca}).Info("over tls")
+	if msg := readFramed(t, acceptOne(t, ln)); !strings.HasSuffix(msg, `msg="over tls"`) {
+		t.Errorf("unexpected message: %q", msg)
+	}
+
+	if _, err := newLogHandler(LogConfig{Backend: "remote", Remote: RemoteSyslogConfig{Network: "tls", Address: ln.Addr().String(), CA: keyPEMFile(t, keyPEM), Buffer: 1}}, slog.LevelInfo, nil); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+}
+
+func keyPEMFile(t *testing.T, keyPEM []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(path, keyPEM, 0600)
+	return path
+}
+
+// TestRemoteSyslogUnreachable checks that logging doesn't block while the
+// collector is down, that what doesn't fit in the buffer is dropped and
+// reported, and that the rest is delivered once it is back.
+func TestRemoteSyslogUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	log := newRemoteLogger(t, RemoteSyslogConfig{Network: "tcp", Address: addr, Buffer: 2})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		log.Info("queued", "n", i)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("logging blocked for %s", d)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen again on %s: %s", addr, err)
+	}
+	defer ln.Close()
+	r := acceptOne(t, ln)
+	var got []string
+	for len(got) < 2 || !strings.Contains(strings.Join(got, "\n"), "Dropped") {
+		got = append(got, readFramed(t, r))
+	}
+	all := strings.Join(got, "\n")
+	if !strings.Contains(all, "n=0") || !strings.Contains(all, `msg="Dropped log messages" dropped=`) {
+		t.Errorf("unexpected messages: %q", got)
+	}
+}
+
+// TestRemoteSyslogCritical checks a critical message, after which pollen
+// exits, is only handed back once it and those queued before it were sent,
+// and that pollen doesn't wait for ever when the collector is down.
+func TestRemoteSyslogCritical(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	r, err := newRemoteSyslog(RemoteSyslogConfig{Network: "tcp", Address: addr, Buffer: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.send(slog.LevelInfo, "msg=queued")
+	if err := r.send(LevelCritical, "msg=exiting"); err != nil {
+		t.Fatalf("critical message not sent: %s", err)
+	}
+	// sent means written to the connection, so the collector can read both
+	// even once the sender is gone
+	b := acceptOne(t, ln)
+	if msg := readFramed(t, b); !strings.HasSuffix(msg, "msg=queued") {
+		t.Errorf("unexpected message: %q", msg)
+	}
+	if msg := readFramed(t, b); !strings.HasPrefix(msg, "<26>1 ") || !strings.HasSuffix(msg, "msg=exiting") {
+		t.Errorf("unexpected message: %q", msg)
+	}
+	ln.Close()
+
+	r, err = newRemoteSyslog(RemoteSyslogConfig{Network: "tcp", Address: addr, Buffer: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.flushTimeout = 50 * time.Millisecond
+	if err := r.send(LevelEmergency, "msg=exiting"); err != errRemoteFlush {
+		t.Errorf("expected a timeout with the collector down, got: %v", err)
+	}
+}
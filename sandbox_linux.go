@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxRule grants access to a path once the Landlock ruleset is applied.
+type sandboxRule struct {
+	path   string
+	access uint64
+}
+
+const (
+	landlockRead      = unix.LANDLOCK_ACCESS_FS_READ_FILE
+	landlockReadWrite = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE
+	landlockReadDir   = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockCreate    = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG
+)
+
+// resolverFiles are read to look up host names, e.g. a remote collector's.
+var resolverFiles = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf"}
+
+// sandboxRules lists the paths pollen still needs once it is serving: the
+// device, the directories of the certificates and of the configuration,
+// both reread on reload, the directory the access log is reopened in, the
+// resolver's files when logging or tracing to a remote collector, the
+// kernel's random pool statistics and the process statistics exported as
+// metrics. A rule on a file holds for the file pollen started with, so the
+// files pollen rereads are allowed by their directories, to be read again
+// once replaced.
+func sandboxRules(cfg *Config) []sandboxRule {
+	rules := []sandboxRule{
+		{cfg.Source.Device, landlockReadWrite},
+		{"/proc/sys/kernel/random", landlockReadDir},
+		{"/proc/self", landlockReadDir},
+	}
+	reread := []string{*configPath}
+	for _, spec := range cfg.servedSpecs() {
+		if spec.Scheme != "https" {
+			continue
+		}
+		profile, _ := cfg.tlsProfile(spec.TLSProfile)
+		reread = append(reread, profile.Cert, profile.Key)
+	}
+	for _, path := range reread {
+		for _, dir := range fileDirs(path) {
+			rules = append(rules, sandboxRule{dir, landlockRead})
+		}
+	}
+	if cfg.AccessLog.Enabled && cfg.AccessLog.Path != "" && cfg.AccessLog.Path != "-" {
+		rules = append(rules, sandboxRule{filepath.Dir(cfg.AccessLog.Path), landlockCreate})
+	}
+	if cfg.Log.Backend == "remote" || cfg.Tracing.Endpoint != "" || cfg.Metrics.Push.enabled() {
+		for _, f := range resolverFiles {
+			rules = append(rules, sandboxRule{f, landlockRead})
+		}
+	}
+	return rules
+}
+
+// fileDirs returns the directory of path and, if path is a symlink, that of
+// the file it points to, so that the file can be replaced in either, as
+// certbot does by pointing a symlink to a file it renewed next to the old
+// one. It returns nothing for an empty path.
+func fileDirs(path string) []string {
+	if path == "" {
+		return nil
+	}
+	dirs := []string{filepath.Dir(path)}
+	if target, err := filepath.EvalSymlinks(path); err == nil && filepath.Dir(target) != dirs[0] {
+		dirs = append(dirs, filepath.Dir(target))
+	}
+	return dirs
+}
+
+// applySandbox confines pollen with Landlock and seccomp, returning what was
+// applied and what was not, because the kernel, the build or an outer
+// sandbox does not support it.
+func applySandbox(cfg *Config) (applied, skipped []string, err error) {
+	// Both need no_new_privs, and seccomp carries it over to every thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return nil, nil, fmt.Errorf("cannot set no_new_privs: %s", err)
+	}
+	if abi, err := applyLandlock(sandboxRules(cfg)); err == nil {
+		applied = append(applied, fmt.Sprintf("landlock ABI %d", abi))
+	} else {
+		skipped = append(skipped, fmt.Sprintf("landlock: %s", err))
+	}
+	if n, err := applySeccomp(); err == nil {
+		applied = append(applied, fmt.Sprintf("seccomp allowing %d syscalls", n))
+	} else {
+		skipped = append(skipped, fmt.Sprintf("seccomp: %s", err))
+	}
+	return applied, skipped, nil
+}
+
+// applyLandlock restricts filesystem access to the given rules for every
+// thread. Landlock only applies to the calling thread, so the ruleset is
+// enforced with AllThreadsSyscall, which is unavailable in cgo builds.
+func applyLandlock(rules []sandboxRule) (int, error) {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, errno
+	}
+	abi := int(v)
+	// Every access right known to this ABI is denied unless a rule allows it
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return abi, errno
+	}
+	defer unix.Close(int(fd))
+	for _, r := range rules {
+		if r.path == "" {
+			continue
+		}
+		pfd, err := unix.Open(r.path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			// nothing to allow if it doesn't exist
+			continue
+		}
+		beneath := unix.LandlockPathBeneathAttr{Allowed_access: r.access, Parent_fd: int32(pfd)}
+		_, _, errno = unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&beneath)), 0, 0, 0)
+		unix.Close(pfd)
+		if errno != 0 {
+			return abi, fmt.Errorf("%s: %s", r.path, errno)
+		}
+	}
+	if _, _, errno = syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno == syscall.ENOTSUP {
+		return abi, errors.New("not supported in builds with cgo enabled")
+	} else if errno != 0 {
+		return abi, errno
+	}
+	if _, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return abi, errno
+	}
+	return abi, nil
+}
+
+var errSeccompArch = errors.New("no syscall list for " + runtime.GOARCH)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	// offsets into struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// seccompFilter builds a BPF program allowing the given syscalls for arch
+// and failing every other one with EPERM.
+func seccompFilter(arch uint32, syscalls []uintptr) []unix.SockFilter {
+	deny := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	prog := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+	}
+	for _, nr := range syscalls {
+		prog = append(prog,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: uint32(nr)},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+	}
+	return append(prog, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny})
+}
+
+// applySeccomp installs the syscall filter on every thread.
+func applySeccomp() (int, error) {
+	if seccompArch == 0 {
+		return 0, errSeccompArch
+	}
+	prog := seccompFilter(seccompArch, seccompSyscalls)
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(prog)
+	if errno != 0 {
+		return 0, errno
+	}
+	if tid != 0 {
+		return 0, fmt.Errorf("thread %d could not be synchronized", tid)
+	}
+	return len(seccompSyscalls), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSandboxHelper is run in a child process by TestSandbox, since the
+// sandbox can't be removed once applied.
+func TestSandboxHelper(t *testing.T) {
+	if os.Getenv("POLLEN_TEST_SANDBOX") == "" {
+		t.Skip("only run as a helper process")
+	}
+	cfg := defaultConfig()
+	cfg.HTTPS.Enabled = false
+	cfg.Source.Device = "/dev/urandom"
+	applied, skipped, err := applySandbox(cfg)
+	if err != nil {
+		t.Fatalf("applySandbox failed: %s", err)
+	}
+	t.Logf("applied: %v skipped: %v", applied, skipped)
+	landlocked := strings.Contains(strings.Join(applied, " "), "landlock")
+	if _, err := os.ReadFile("/etc/hostname"); landlocked && err == nil {
+		t.Error("landlock did not restrict reading files")
+	}
+	if _, err := os.ReadFile("/proc/sys/kernel/random/entropy_avail"); err != nil {
+		t.Errorf("cannot read entropy_avail: %s", err)
+	}
+	if err := syscall.Chroot("/"); err == nil && strings.Contains(strings.Join(applied, " "), "seccomp") {
+		t.Error("seccomp did not restrict chroot")
+	}
+
+	// pollen still serves over plain and TLS connections
+	s := NewSuite(t)
+	defer s.TearDown()
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	if err != nil {
+		t.Fatalf("http client error: %s", err)
+	}
+	chal, _, err := ReadResp(res.Body)
+	res.Body.Close()
+	if err != nil || chal != PorkChopSha512 {
+		t.Errorf("unexpected response %q: %v", chal, err)
+	}
+	tlsServer := httptest.NewTLSServer(s.pollen)
+	defer tlsServer.Close()
+	res, err = tlsServer.Client().Get(tlsServer.URL + "?challenge=pork+chop+sandwiches")
+	if err != nil {
+		t.Fatalf("https client error: %s", err)
+	}
+	res.Body.Close()
+}
+
+// TestSandbox applies the sandbox in a child process and checks pollen still
+// works inside it.
+func TestSandbox(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandboxHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), "POLLEN_TEST_SANDBOX=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: TestSandboxHelper") {
+		t.Errorf("helper failed: %v\n%s", err, out)
+	}
+	t.Logf("%s", out)
+}
+
+// sandboxed applies the sandbox for cfg in a helper process and waits for
+// runSandboxHelper to be done changing files, returning whether Landlock was
+// applied.
+func sandboxed(t *testing.T, cfg *Config) bool {
+	applied, skipped, err := applySandbox(cfg)
+	if err != nil {
+		t.Fatalf("applySandbox failed: %s", err)
+	}
+	t.Logf("applied: %v skipped: %v", applied, skipped)
+	fmt.Println("sandboxed")
+	io.ReadAll(os.Stdin)
+	return strings.Contains(strings.Join(applied, " "), "landlock")
+}
+
+// runSandboxHelper runs the helper test name in a child process with env
+// added to its environment. Once the helper is sandboxed, replace is called
+// to change files under its feet, and the helper carries on.
+func runSandboxHelper(t *testing.T, name string, env []string, replace func()) {
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$", "-test.v")
+	cmd.Env = append(append(os.Environ(), "POLLEN_TEST_SANDBOX=1"), env...)
+	var out, stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fmt.Fprintln(&out, scanner.Text())
+		if scanner.Text() == "sandboxed" {
+			replace()
+			stdin.Close()
+		}
+	}
+	stdin.Close()
+	err = cmd.Wait()
+	out.Write(stderr.Bytes())
+	if err != nil || !strings.Contains(out.String(), "--- PASS: "+name) {
+		t.Errorf("helper failed: %v\n%s", err, out.String())
+	}
+	t.Logf("%s", out.String())
+}
+
+// replaceFile writes content next to path and renames it over path, as
+// editors and configuration management do.
+func replaceFile(t *testing.T, path, content string) {
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSandboxReloadHelper is run in a child process by TestSandboxReload.
+func TestSandboxReloadHelper(t *testing.T) {
+	if os.Getenv("POLLEN_TEST_SANDBOX") == "" {
+		t.Skip("only run as a helper process")
+	}
+	defer func(path string) { *configPath = path }(*configPath)
+	*configPath = os.Getenv("POLLEN_TEST_CONFIG")
+	// pollen refuses variables it doesn't know
+	os.Unsetenv("POLLEN_TEST_SANDBOX")
+	os.Unsetenv("POLLEN_TEST_CONFIG")
+	cfg := defaultConfig()
+	cfg.HTTPS.Enabled = false
+	cfg.Source.Device = "/dev/urandom"
+	p := &PollenServer{}
+	landlocked := sandboxed(t, cfg)
+	if err := p.reloadACLs(); err != nil {
+		t.Fatalf("cannot reload the replaced configuration: %s", err)
+	}
+	if p.acls.Load().check("test", net.ParseIP("127.0.0.1")) == "" {
+		t.Error("replaced configuration not applied")
+	}
+	if _, err := os.ReadFile("/etc/hostname"); landlocked && err == nil {
+		t.Error("landlock did not restrict reading files")
+	}
+}
+
+// TestSandboxReload checks the configuration can still be reloaded in the
+// sandbox after it was replaced by a rename.
+func TestSandboxReload(t *testing.T) {
+	path := writeConfig(t, "listeners:\n  - name: test\n    address: \":8080\"\n")
+	runSandboxHelper(t, "TestSandboxReloadHelper", []string{"POLLEN_TEST_CONFIG=" + path}, func() {
+		replaceFile(t, path, "listeners:\n  - name: test\n    address: \":8080\"\n    deny: [\"127.0.0.0/8\"]\n")
+	})
+}
+
+// TestSandboxRenewHelper is run in a child process by TestSandboxRenew.
+func TestSandboxRenewHelper(t *testing.T) {
+	if os.Getenv("POLLEN_TEST_SANDBOX") == "" {
+		t.Skip("only run as a helper process")
+	}
+	cfg := defaultConfig()
+	cfg.HTTPS.Enabled = true
+	cfg.Source.Device = "/dev/urandom"
+	cfg.TLS.Cert, cfg.TLS.Key = os.Getenv("POLLEN_TEST_CERT"), os.Getenv("POLLEN_TEST_KEY")
+	_, cert, err := cfg.TLS.serverConfig()
+	if err != nil {
+		t.Fatalf("cannot load the certificate: %s", err)
+	}
+	old := cert.cert.Load().Certificate[0]
+	sandboxed(t, cfg)
+	if err := cert.load(); err != nil {
+		t.Fatalf("cannot reload the renewed certificate: %s", err)
+	}
+	if bytes.Equal(cert.cert.Load().Certificate[0], old) {
+		t.Error("renewed certificate not loaded")
+	}
+}
+
+// TestSandboxRenew checks certificates can still be reloaded in the sandbox
+// after they were renewed the way certbot does it, by writing new files next
+// to the old ones and renaming symlinks over those pollen is configured with.
+func TestSandboxRenew(t *testing.T) {
+	dir := t.TempDir()
+	archive, live := filepath.Join(dir, "archive"), filepath.Join(dir, "live")
+	os.Mkdir(archive, 0755)
+	os.Mkdir(live, 0755)
+	opts := certOptions{keyType: "ecdsa", hosts: []string{"localhost"}, lifetime: time.Hour}
+	renew := func(n int) {
+		for _, name := range []string{"cert", "key"} {
+			link := filepath.Join(live, name+".pem")
+			os.Remove(link + ".new")
+			if err := os.Symlink(fmt.Sprintf("../archive/%s%d.pem", name, n), link+".new"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := writeCert(filepath.Join(archive, fmt.Sprintf("cert%d.pem", n)), filepath.Join(archive, fmt.Sprintf("key%d.pem", n)), opts, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"cert", "key"} {
+			link := filepath.Join(live, name+".pem")
+			if err := os.Rename(link+".new", link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	renew(1)
+	env := []string{"POLLEN_TEST_CERT=" + filepath.Join(live, "cert.pem"), "POLLEN_TEST_KEY=" + filepath.Join(live, "key.pem")}
+	runSandboxHelper(t, "TestSandboxRenewHelper", env, func() { renew(2) })
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func applySandbox(cfg *Config) (applied, skipped []string, err error) {
+	return nil, []string{"landlock and seccomp are only supported on Linux"}, nil
+}
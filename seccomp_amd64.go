@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const seccompArch = unix.AUDIT_ARCH_X86_64
+
+// seccompSyscalls adds the legacy syscalls only amd64 has, which the Go
+// runtime and standard library still use there.
+var seccompSyscalls = append(commonSyscalls,
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_NEWFSTATAT,
+	unix.SYS_POLL, unix.SYS_SELECT, unix.SYS_EPOLL_WAIT, unix.SYS_EPOLL_CREATE,
+	unix.SYS_PIPE, unix.SYS_DUP2, unix.SYS_ACCESS, unix.SYS_READLINK,
+	unix.SYS_ARCH_PRCTL, unix.SYS_TIME, unix.SYS_RENAME, unix.SYS_UNLINK,
+	unix.SYS_GETDENTS,
+)
@@ -0,0 +1,9 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const seccompArch = unix.AUDIT_ARCH_AARCH64
+
+var seccompSyscalls = append(commonSyscalls, unix.SYS_FSTATAT)
@@ -0,0 +1,8 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+// seccompArch is zero where pollen has no syscall list, which skips seccomp.
+const seccompArch = 0
+
+var seccompSyscalls []uintptr
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ServerConfig holds the limits applied to every HTTP server pollen runs, so
+// that slow or oversized clients can't tie up connections.
+type ServerConfig struct {
+	// ReadHeaderTimeout bounds reading the request headers, and ReadTimeout
+	// the whole request including the body
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	// WriteTimeout bounds everything from the end of the headers to the end
+	// of the response
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout bounds the wait for the next request on a keep-alive
+	// connection
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes int           `yaml:"max_header_bytes"`
+	MaxBodyBytes   int64         `yaml:"max_body_bytes"`
+}
+
+// validate checks the server limits. Zero timeouts would disable them, so
+// they must be positive.
+func (s ServerConfig) validate() error {
+	for _, d := range []time.Duration{s.ReadHeaderTimeout, s.ReadTimeout, s.WriteTimeout, s.IdleTimeout} {
+		if d <= 0 {
+			return errors.New("server timeouts must be positive")
+		}
+	}
+	if s.MaxHeaderBytes <= 0 || s.MaxBodyBytes <= 0 {
+		return errors.New("server max_header_bytes and max_body_bytes must be positive")
+	}
+	return nil
+}
+
+// newServer creates an http.Server for h with the configured limits.
+func (s ServerConfig) newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           limitBody(h, s.MaxBodyBytes),
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+	}
+}
+
+// limitBody refuses requests declaring a body larger than n bytes, and cuts
+// off any that turn out to be.
+func limitBody(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
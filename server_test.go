@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLimitedServer serves pollen on a local port with short limits, so that
+// slow clients are cut off quickly.
+func newLimitedServer(t *testing.T) (*Suite, string) {
+	s := NewSuite(t)
+	cfg := ServerConfig{
+		ReadHeaderTimeout: 200 * time.Millisecond,
+		ReadTimeout:       400 * time.Millisecond,
+		WriteTimeout:      time.Second,
+		IdleTimeout:       time.Second,
+		MaxHeaderBytes:    1 << 10,
+		MaxBodyBytes:      256,
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("invalid server config: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	server := cfg.newServer(s.pollen)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return s, ln.Addr().String()
+}
+
+// assertCutOff checks that the server closes conn well before a client
+// trickling a request would have finished.
+func assertCutOff(t *testing.T, conn net.Conn, trickle string) {
+	start := time.Now()
+	for _, c := range trickle {
+		if _, err := fmt.Fprintf(conn, "%c", c); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("slow client was never cut off")
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("slow client took %s to be cut off", d)
+	}
+}
+
+// TestSlowHeaders trickles the request headers in one byte at a time.
+func TestSlowHeaders(t *testing.T) {
+	s, addr := newLimitedServer(t)
+	defer s.TearDown()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	assertCutOff(t, conn, "GET /?challenge=xxx HTTP/1.1\r\nHost: pollen\r\n"+strings.Repeat("X-Slow: loris\r\n", 20))
+}
+
+// TestSlowBody sends the headers promptly then trickles the body in.
+func TestSlowBody(t *testing.T) {
+	s, addr := newLimitedServer(t)
+	defer s.TearDown()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: pollen\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 200\r\n\r\n")
+	assertCutOff(t, conn, "challenge="+strings.Repeat("x", 190))
+}
+
+// TestOversizedRequests checks the header and body size limits.
+func TestOversizedRequests(t *testing.T) {
+	s, addr := newLimitedServer(t)
+	defer s.TearDown()
+
+	res, err := http.Post("http://"+addr, "application/x-www-form-urlencoded", strings.NewReader("challenge="+strings.Repeat("x", 1000)))
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusRequestEntityTooLarge, "expected Request Entity Too Large, got: ", res.Status)
+
+	// a chunked body has no length up front
+	res, err = http.Post("http://"+addr, "application/x-www-form-urlencoded", io.MultiReader(strings.NewReader("challenge="), strings.NewReader(strings.Repeat("x", 1000))))
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode != http.StatusOK, "chunked oversized body was served")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /?challenge=xxx HTTP/1.1\r\nHost: pollen\r\nX-Big: %s\r\n\r\n", strings.Repeat("x", 8<<10))
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	s.Assert(err == nil, "cannot read response:", err)
+	s.Assert(res.StatusCode == http.StatusRequestHeaderFieldsTooLarge, "expected Request Header Fields Too Large, got: ", res.Status)
+
+	res, err = http.Post("http://"+addr, "application/x-www-form-urlencoded", strings.NewReader("challenge=xxx"))
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "small request failed: ", res.Status)
+}
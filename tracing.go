@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces URL spans are exported to, e.g.
+	// http://localhost:4318/v1/traces, or empty not to trace
+	Endpoint string `yaml:"endpoint"`
+	// CA is a PEM file of the CAs an https endpoint's certificate is
+	// checked against, the system's if empty
+	CA string `yaml:"ca"`
+	// Buffer is the number of finished spans held for export, beyond which
+	// they are dropped
+	Buffer int `yaml:"buffer"`
+	// Interval is how often the finished spans are exported
+	Interval time.Duration `yaml:"interval"`
+}
+
+// validate checks the tracing settings.
+func (c TracingConfig) validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid tracing endpoint %q", c.Endpoint)
+	}
+	if c.Buffer < 1 || c.Interval <= 0 {
+		return errors.New("tracing buffer and interval must be positive")
+	}
+	return nil
+}
+
+const (
+	// tracingBatch is the most spans exported in one request
+	tracingBatch   = 512
+	tracingTimeout = 10 * time.Second
+	// OTLP span kinds and status codes
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// maxRequestIDLength bounds the X-Request-ID values taken from clients.
+const maxRequestIDLength = 128
+
+// Tracer records spans and exports them to an OTLP collector from a
+// goroutine of its own, so that requests never wait on the collector.
+type Tracer struct {
+	endpoint string
+	client   *http.Client
+	log      *slog.Logger
+	spans    chan *Span
+	interval time.Duration
+}
+
+// NewTracer starts exporting spans to the configured endpoint, or returns
+// nil if tracing is off.
+func NewTracer(cfg TracingConfig, log *slog.Logger) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	// the CAs are loaded now, while pollen can still read them
+	roots, err := x509.SystemCertPool()
+	if cfg.CA != "" {
+		roots = x509.NewCertPool()
+		var pem []byte
+		if pem, err = os.ReadFile(cfg.CA); err == nil && !roots.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificates in %s", cfg.CA)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	t := &Tracer{
+		endpoint: cfg.Endpoint,
+		client:   &http.Client{Transport: transport, Timeout: tracingTimeout},
+		log:      log,
+		spans:    make(chan *Span, cfg.Buffer),
+		interval: cfg.Interval,
+	}
+	go t.run()
+	return t, nil
+}
+
+// traceContext is what a request carries from its traceparent header, or
+// what is made up for it when there is none.
+type traceContext struct {
+	traceID string
+	// parentID is the caller's span, empty if it didn't send one
+	parentID string
+	// sampled is false when the caller asked for the trace not to be
+	// recorded
+	sampled bool
+}
+
+type traceContextKey struct{}
+type spanKey struct{}
+
+// parseTraceParent reads a W3C traceparent header,
+// version-traceid-parentid-flags in lower case hex.
+func parseTraceParent(h string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	for i, n := range []int{2, 32, 16, 2} {
+		if len(parts[i]) != n || !isLowerHex(parts[i]) {
+			return traceContext{}, false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return traceContext{}, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return traceContext{traceID: parts[1], parentID: parts[2], sampled: flags&1 == 1}, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validRequestID checks a client's X-Request-ID is short and printable, so
+// that it is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("-_.:+/=", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withTraceContext puts the request ID and trace context of r in its
+// context. The request ID is the client's X-Request-ID, or failing that its
+// trace ID, or failing that a new one.
+func withTraceContext(r *http.Request) *http.Request {
+	tc, traced := parseTraceParent(r.Header.Get("traceparent"))
+	id := r.Header.Get("X-Request-ID")
+	switch {
+	case validRequestID(id):
+	case traced:
+		id = tc.traceID
+	default:
+		id = newRequestID()
+	}
+	if !traced {
+		tc = traceContext{traceID: randomHex(16), sampled: true}
+	}
+	ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+	ctx = context.WithValue(ctx, traceContextKey{}, tc)
+	return r.WithContext(ctx)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Span is an operation timed for a trace.
+type Span struct {
+	tracer   *Tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+// Start begins a span named name, the child of the span in ctx or else of
+// the request's caller, and returns a context carrying it. If the Tracer
+// receiver is nil, or the caller asked for the trace not to be recorded, it
+// returns ctx and a nil Span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, spanID: randomHex(8), name: name, kind: spanKindInternal, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		tc, ok := ctx.Value(traceContextKey{}).(traceContext)
+		if !ok {
+			tc = traceContext{traceID: randomHex(16), sampled: true}
+		}
+		if !tc.sampled {
+			return ctx, nil
+		}
+		s.traceID, s.parentID, s.kind = tc.traceID, tc.parentID, spanKindServer
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttr adds an attribute to the span. If the Span receiver is nil, the
+// function does nothing.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// Fail marks the span as failed with err. If the Span receiver is nil, the
+// function does nothing.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export, dropping it if the queue
+// is full. If the Span receiver is nil, the function does nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// run exports the finished spans every interval, or as soon as there are a
+// batch of them.
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	failing := false
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < tracingBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := t.export(batch)
+		switch {
+		case err != nil && !failing:
+			t.log.Warn("Cannot export spans", "endpoint", t.endpoint, "error", err)
+		case err == nil && failing:
+			t.log.Info("Exporting spans again", "endpoint", t.endpoint)
+		}
+		failing = err != nil
+		batch = nil
+	}
+}
+
+// OTLP/HTTP JSON encoding of spans, with IDs in hex and times as decimal
+// strings of nanoseconds.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string        `json:"key"`
+	Value otlpAttrValue `json:"value"`
+}
+
+type otlpAttrValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpAttr {
+	var out []otlpAttr
+	for k, v := range attrs {
+		out = append(out, otlpAttr{k, otlpAttrValue{v}})
+	}
+	return out
+}
+
+// export sends spans to the collector.
+func (t *Tracer) export(spans []*Span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "pollen"}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.attrs),
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	body, err := json.Marshal(otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{otlpAttrs(map[string]string{"service.name": "pollen"})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", res.Status)
+	}
+	return nil
+}
+
+// traced wraps h in a span for the whole request. If the Tracer receiver is
+// nil, it returns h.
+func (t *Tracer) traced(h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := t.Start(r.Context(), "pollen.request")
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("pollen.listener", listenerName(ctx))
+		span.SetAttr("pollen.request_id", requestID(ctx))
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			span.SetAttr("http.response.status_code", strconv.Itoa(rec.status))
+			if rec.status >= 500 {
+				span.Fail(errors.New(http.StatusText(rec.status)))
+			}
+			span.End()
+		}()
+		h.ServeHTTP(rec, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestParseTraceParent checks valid and invalid traceparent headers.
+func TestParseTraceParent(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", true, false},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-future", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra", false, false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"garbage", false, false},
+	} {
+		got, ok := parseTraceParent(tc.header)
+		if ok != tc.ok || got.sampled != tc.sampled {
+			t.Errorf("%s: unexpected result: %+v %v", tc.header, got, ok)
+		}
+	}
+}
+
+// TestRequestIDHeader checks the request ID returned to clients is theirs,
+// or their trace ID, or else a new one.
+func TestRequestIDHeader(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy"}}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		requestID, traceParent, want string
+	}{
+		{"vm-1234", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "vm-1234"},
+		{"", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "0af7651916cd43dd8448eb211c80319c"},
+		{"bad id; with spaces", "", ""},
+		{"", "", ""},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"?challenge=xxx", nil)
+		if tc.requestID != "" {
+			req.Header.Set("X-Request-ID", tc.requestID)
+		}
+		if tc.traceParent != "" {
+			req.Header.Set("traceparent", tc.traceParent)
+		}
+		res, err := http.DefaultClient.Do(req)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		got := res.Header.Get("X-Request-ID")
+		if tc.want != "" {
+			s.Assert(got == tc.want, "expected request ID", tc.want, "got", got)
+		} else {
+			s.Assert(len(got) == 16, "expected a new request ID, got", got)
+		}
+	}
+	s.logger.mu.Lock()
+	defer s.logger.mu.Unlock()
+	s.Assert(s.logger.logs[0].attrs["request_id"] == "vm-1234", "request ID not logged:", s.logger.logs[0])
+}
+
+// TestTracingExport serves a traced request and checks the spans reach a
+// collector with the caller's trace ID and the right parents.
+func TestTracingExport(t *testing.T) {
+	received := make(chan otlpRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	s := NewSuite(t)
+	defer s.TearDown()
+	var err error
+	s.pollen.tracer, err = NewTracer(TracingConfig{Endpoint: collector.URL + "/v1/traces", Buffer: 100, Interval: 10 * time.Millisecond}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewTracer failed: %s", err)
+	}
+	server := httptest.NewServer(s.pollen.listenerHandler(ListenerSpec{Name: "test", Routes: []string{"entropy"}}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"?challenge=xxx", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http client error: %s", err)
+	}
+	res.Body.Close()
+
+	spans := make(map[string]otlpSpan)
+	timeout := time.After(5 * time.Second)
+	for len(spans) < 5 {
+		select {
+		case req := <-received:
+			for _, span := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+				spans[span.Name] = span
+			}
+		case <-timeout:
+			t.Fatalf("only got spans: %v", spans)
+		}
+	}
+	root := spans["pollen.request"]
+	if root.TraceID != "0af7651916cd43dd8448eb211c80319c" || root.ParentSpanID != "b7ad6b7169203331" || root.Kind != spanKindServer {
+		t.Errorf("wrong root span: %+v", root)
+	}
+	for _, name := range []string{"challenge.hash", "device.write", "device.read", "response.write"} {
+		span, ok := spans[name]
+		if !ok || span.TraceID != root.TraceID || span.ParentSpanID != root.SpanID || span.Status.Code != 0 {
+			t.Errorf("wrong %s span: %+v", name, span)
+		}
+	}
+}